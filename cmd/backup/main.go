@@ -1,30 +1,89 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/urfave/cli/v2"
 	"github.com/jdollar/backup/internal/commands"
 	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
 )
 
+const LOG_FORMAT_FLAG = "log-format"
+const LOG_LEVEL_FLAG = "log-level"
+
+
 func main() {
   conf, err := config.NewConfiguration()
   if err != nil {
-    log.Fatal(err)
+    slog.Error("Error loading configuration", logging.Err(err))
+    os.Exit(commands.EXIT_CONFIG)
   }
 
   app := &cli.App{
     Name: "backup",
     Usage: "Cli tool to backup files to dropbox",
+    Flags: []cli.Flag{
+      &cli.StringFlag{
+        Name: LOG_FORMAT_FLAG,
+        Usage: "Log output format, text or json",
+        EnvVars: []string{"BACKUP_LOG_FORMAT"},
+        Value: logging.FORMAT_TEXT,
+      },
+      &cli.StringFlag{
+        Name: LOG_LEVEL_FLAG,
+        Usage: "Lowest level logged, debug, info, warn or error",
+        EnvVars: []string{"BACKUP_LOG_LEVEL"},
+        Value: "info",
+      },
+    },
+    Before: func(c *cli.Context) error {
+      err := logging.Setup(os.Stderr, c.String(LOG_FORMAT_FLAG), c.String(LOG_LEVEL_FLAG))
+      if err != nil {
+        return cli.Exit(err.Error(), commands.EXIT_CONFIG)
+      }
+      return nil
+    },
+    // Errors come back from RunContext and are handled below, exiting
+    // in here would skip what the command still has to clean up
+    ExitErrHandler: func(c *cli.Context, err error) {},
     Commands: []*cli.Command{
       commands.NewBackupCommand(conf),
+      commands.NewDiffCommand(conf),
+      commands.NewRestoreCommand(conf),
+      commands.NewRepoCommand(conf),
+      commands.NewDaemonCommand(conf),
+      commands.NewWatchCommand(conf),
+      commands.NewRunCommand(conf),
+      commands.NewCopyCommand(conf),
+      commands.NewSyncCommand(conf),
+      commands.NewStatusCommand(conf),
+      commands.NewHistoryCommand(conf),
+      commands.NewCheckCommand(conf),
     },
   }
 
-  err = app.Run(os.Args)
+  // The first signal cancels the running command so it can abort
+  // uploads and remove partial archives, a second one kills it
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  go func() {
+    <-ctx.Done()
+    stop()
+  }()
+
+  err = app.RunContext(ctx, os.Args)
+  if err != nil && ctx.Err() != nil {
+    slog.Warn("Interrupted", logging.Err(err))
+    os.Exit(commands.EXIT_INTERRUPTED)
+  }
   if err != nil {
-    log.Fatal(err)
+    if err.Error() != "" {
+      slog.Error(err.Error())
+    }
+    os.Exit(commands.ExitCode(err))
   }
 }
@@ -1,17 +1,22 @@
 module github.com/jdollar/backup
 
-go 1.18
+go 1.21
 
 require (
 	github.com/urfave/cli/v2 v2.4.0
 	golang.org/x/oauth2 v0.0.0-20220309155454-6242fa91716a
 )
 
-require github.com/spf13/viper v1.10.1
+require (
+	github.com/fsnotify/fsnotify v1.5.1
+	github.com/spf13/viper v1.10.1
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/sys v0.4.0
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/kr/pretty v0.2.0 // indirect
@@ -25,11 +30,9 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/subosito/gotenv v1.2.0 // indirect
 	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/ini.v1 v1.66.2 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -2,7 +2,7 @@ package box
 
 import (
 	"bytes"
-  "log"
+  "log/slog"
 	"context"
 	"crypto/sha1"
 	"encoding/base64"
@@ -17,14 +17,28 @@ import (
   "time"
   "strconv"
   "sort"
+  "sync"
 
   "github.com/jdollar/backup/internal/files"
+  "github.com/jdollar/backup/internal/progress"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
-const TWENTY_MB = 20*1024
+const TWENTY_MB = 20*1024*1024
+
+// MAX_PARALLEL_PARTS is how many parts of a chunked upload are sent at
+// once, which also bounds how much of the file is held in memory
+const MAX_PARALLEL_PARTS = 4
+
+// ABORT_TIMEOUT bounds aborting an upload session, which happens after
+// the upload's own context may already be cancelled
+const ABORT_TIMEOUT = 30 * time.Second
+
+// MAX_RATE_LIMIT_RETRIES is how often a rate limited part is sent again
+// before the upload gives up
+const MAX_RATE_LIMIT_RETRIES = 5
 
 type ClientOpts struct {
   SubjectType string
@@ -35,6 +49,7 @@ type ClientOpts struct {
 
 type Client struct {
   httpClient *http.Client
+  progress progress.Func
 }
 
 func NewClient(ctx context.Context, copts ClientOpts) Client {
@@ -59,20 +74,42 @@ func NewClient(ctx context.Context, copts ClientOpts) Client {
   return client
 }
 
+// SetProgress reports the progress of uploads to report, with the file
+// name as the update name
+func (c *Client) SetProgress(report progress.Func) {
+  c.progress = report
+}
+
+func (c *Client) reportProgress(update progress.Update) {
+  if c.progress != nil {
+    c.progress(update)
+  }
+}
+
+// handleResponse decodes a successful response into result. Any other
+// status is returned as a *ClientError.
 func (c *Client) handleResponse(resp *http.Response, result interface{}) error {
   if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-    var errResp ClientError
-    err := json.NewDecoder(resp.Body).Decode(&errResp)
-    if err != nil {
-      return err
+    // Not every failure has a JSON body, the status is enough to tell
+    // them apart
+    errResp := &ClientError{}
+    json.NewDecoder(resp.Body).Decode(errResp)
+    errResp.Status = resp.StatusCode
+    if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+      errResp.RetryAfter = time.Duration(seconds) * time.Second
     }
 
-    if errResp.Message != "" {
-      return errors.New(errResp.Message)
-    }
+    slog.Debug(
+      "Box request failed",
+      "status", errResp.Status,
+      "code", errResp.Code,
+      "request_id", errResp.RequestId,
+      "error", errResp.Message,
+    )
+    return errResp
   }
 
-  if resp.StatusCode != 204 {
+  if resp.StatusCode != 204 && result != nil {
     err := json.NewDecoder(resp.Body).Decode(&result)
     if err != nil {
       return err
@@ -87,14 +124,16 @@ func (c *Client) makeRequest(req *http.Request, resp interface{}) error {
   if err != nil {
     return err
   }
+  defer rawResp.Body.Close()
 
-  return c.handleResponse(rawResp, &resp)
+  return c.handleResponse(rawResp, resp)
 }
 
-func (c *Client) SearchFolders(name string) (SearchResponse, error) {
+func (c *Client) SearchFolders(ctx context.Context, name string) (SearchResponse, error) {
   var searchResponse SearchResponse
 
-  req, err := http.NewRequest(
+  req, err := http.NewRequestWithContext(
+    ctx,
     http.MethodGet,
     "https://api.box.com/2.0/search",
     nil,
@@ -111,10 +150,11 @@ func (c *Client) SearchFolders(name string) (SearchResponse, error) {
   return searchResponse, err
 }
 
-func (c *Client) ListItemsInFolder(folder Folder, limit int64, offset int64) (ListItemsInFolderResponse, error) {
+func (c *Client) ListItemsInFolder(ctx context.Context, folder Folder, limit int64, offset int64) (ListItemsInFolderResponse, error) {
   var resp ListItemsInFolderResponse
 
-  req, err := http.NewRequest(
+  req, err := http.NewRequestWithContext(
+    ctx,
     http.MethodGet,
     fmt.Sprintf("https://api.box.com/2.0/folders/%s/items", folder.Id),
     nil,
@@ -126,6 +166,7 @@ func (c *Client) ListItemsInFolder(folder Folder, limit int64, offset int64) (Li
   q := req.URL.Query()
   q.Add("limit", strconv.FormatInt(limit, 10))
   q.Add("offset", strconv.FormatInt(offset, 10))
+  q.Add("fields", "id,type,name,size,sha1")
   q.Add("sort", "name")
   q.Add("direction", "DESC")
   req.URL.RawQuery = q.Encode()
@@ -134,8 +175,9 @@ func (c *Client) ListItemsInFolder(folder Folder, limit int64, offset int64) (Li
   return resp, err
 }
 
-func (c *Client) DeleteFile(file File) error {
-  req, err := http.NewRequest(
+func (c *Client) DeleteFile(ctx context.Context, file File) error {
+  req, err := http.NewRequestWithContext(
+    ctx,
     http.MethodDelete,
     fmt.Sprintf("https://api.box.com/2.0/files/%s", file.Id),
     nil,
@@ -148,7 +190,33 @@ func (c *Client) DeleteFile(file File) error {
   return err
 }
 
-func (c *Client) CreateBackupFolder(reqBody CreateFolderRequest) (CreateFolderResponse, error) {
+// DownloadFile opens the contents of a file for reading. The caller is
+// responsible for closing the returned reader
+func (c *Client) DownloadFile(ctx context.Context, file File) (io.ReadCloser, error) {
+  req, err := http.NewRequestWithContext(
+    ctx,
+    http.MethodGet,
+    fmt.Sprintf("https://api.box.com/2.0/files/%s/content", file.Id),
+    nil,
+  )
+  if err != nil {
+    return nil, err
+  }
+
+  rawResp, err := c.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+
+  if rawResp.StatusCode < 200 || rawResp.StatusCode >= 300 {
+    defer rawResp.Body.Close()
+    return nil, c.handleResponse(rawResp, nil)
+  }
+
+  return rawResp.Body, nil
+}
+
+func (c *Client) CreateBackupFolder(ctx context.Context, reqBody CreateFolderRequest) (CreateFolderResponse, error) {
   var resp CreateFolderResponse
 
   jsonBody, err := json.Marshal(reqBody)
@@ -156,7 +224,8 @@ func (c *Client) CreateBackupFolder(reqBody CreateFolderRequest) (CreateFolderRe
     return resp, err
   }
 
-  req, err := http.NewRequest(
+  req, err := http.NewRequestWithContext(
+    ctx,
     http.MethodPost,
     "https://api.box.com/2.0/folders",
     bytes.NewBuffer(jsonBody),
@@ -169,7 +238,7 @@ func (c *Client) CreateBackupFolder(reqBody CreateFolderRequest) (CreateFolderRe
   return resp, err
 }
 
-func (c *Client) CreateUploadSession(req CreateUploadSessionRequest) (CreateUploadSessionResponse, error) {
+func (c *Client) CreateUploadSession(ctx context.Context, req CreateUploadSessionRequest) (CreateUploadSessionResponse, error) {
   var resp CreateUploadSessionResponse
 
   jsonBody, err := json.Marshal(req)
@@ -177,7 +246,8 @@ func (c *Client) CreateUploadSession(req CreateUploadSessionRequest) (CreateUplo
     return resp, err
   }
 
-  httpReq, err := http.NewRequest(
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
     http.MethodPost,
     "https://upload.box.com/api/2.0/files/upload_sessions",
     bytes.NewBuffer(jsonBody),
@@ -190,10 +260,11 @@ func (c *Client) CreateUploadSession(req CreateUploadSessionRequest) (CreateUplo
   return resp, err
 }
 
-func (c *Client) GetUploadSession(sessionId string) (GetUploadSessionResponse, error) {
+func (c *Client) GetUploadSession(ctx context.Context, sessionId string) (GetUploadSessionResponse, error) {
   var resp GetUploadSessionResponse
 
-  httpReq, err := http.NewRequest(
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
     http.MethodGet,
     fmt.Sprintf("https://upload.box.com/api/2.0/files/upload_sessions/%s", sessionId),
     nil,
@@ -206,13 +277,29 @@ func (c *Client) GetUploadSession(sessionId string) (GetUploadSessionResponse, e
   return resp, err
 }
 
+// AbortUploadSession discards an upload session along with the parts
+// already uploaded to it
+func (c *Client) AbortUploadSession(ctx context.Context, sessionId string) error {
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
+    http.MethodDelete,
+    fmt.Sprintf("https://upload.box.com/api/2.0/files/upload_sessions/%s", sessionId),
+    nil,
+  )
+  if err != nil {
+    return err
+  }
+
+  return c.makeRequest(httpReq, nil)
+}
+
 type ByOffset []UploadPart
 
 func (a ByOffset) Len() int           { return len(a) }
 func (a ByOffset) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByOffset) Less(i, j int) bool { return a[i].Offset < a[j].Offset }
 
-func (c *Client) CommitUploadSession(sessionId string, parts []UploadPart, digest string) (CommitUploadSessionResponse, error) {
+func (c *Client) CommitUploadSession(ctx context.Context, sessionId string, parts []UploadPart, digest string) (CommitUploadSessionResponse, error) {
   var resp CommitUploadSessionResponse
 
   sort.Sort(ByOffset(parts))
@@ -226,7 +313,8 @@ func (c *Client) CommitUploadSession(sessionId string, parts []UploadPart, diges
     return resp, err
   }
 
-  httpReq, err := http.NewRequest(
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
     http.MethodPost,
     fmt.Sprintf("https://upload.box.com/api/2.0/files/upload_sessions/%s/commit", sessionId),
     bytes.NewBuffer(jsonBody),
@@ -248,159 +336,286 @@ type UploadAttributes struct {
   Parent Folder `json:"parent"`
 }
 
-func (c *Client) Upload(folder Folder, file *os.File) error {
-  info, err := file.Stat()
+// Upload stores size bytes read from r as a new file called name in
+// folder. Files of twenty megabytes or more go through an upload session.
+func (c *Client) Upload(ctx context.Context, folder Folder, name string, r io.Reader, size int64) (File, error) {
+  if size >= TWENTY_MB {
+    return c.chunkedUpload(ctx, folder, name, r, size)
+  }
+
+  file, err := c.singleUpload(ctx, folder, name, r)
   if err != nil {
-    return err
+    return File{}, err
   }
 
-  if info.Size() >= TWENTY_MB {
-    return c.chunkedUpload(folder, file)
+  c.reportProgress(progress.Update{
+    Name: name,
+    Done: size,
+    Total: size,
+  })
+  return file, nil
+}
+
+// UploadFile uploads a local file under its base name
+func (c *Client) UploadFile(ctx context.Context, folder Folder, file *os.File) (File, error) {
+  info, err := file.Stat()
+  if err != nil {
+    return File{}, err
   }
 
-  return c.singleUpload(folder, file)
+  return c.Upload(ctx, folder, info.Name(), file, info.Size())
 }
 
-func (c *Client) singleUpload(folder Folder, file *os.File) error {
-  log.Println("Doing single upload")
+func (c *Client) singleUpload(ctx context.Context, folder Folder, name string, r io.Reader) (File, error) {
+  slog.Debug("Doing single upload", "file", name)
 
   body := &bytes.Buffer{}
   w := multipart.NewWriter(body)
 
-  info, err := file.Stat()
-  if err != nil {
-    return err
-  }
-
   // add fields
   currentDate := time.Now().UTC().Format(time.RFC3339)
   jsonBody, err := json.Marshal(UploadAttributes{
     ContentCreatedAt: currentDate,
     ContentModifiedAt: currentDate,
-    Name: info.Name(),
+    Name: name,
     Parent: folder,
   })
+  if err != nil {
+    return File{}, err
+  }
 
   fw, err := w.CreateFormField("attributes")
   if err != nil {
-    return err
+    return File{}, err
   }
   _, err = io.Copy(fw, bytes.NewBuffer(jsonBody))
   if err != nil {
-    return err
+    return File{}, err
   }
 
-  fw, err = w.CreateFormFile("file", info.Name())
+  fw, err = w.CreateFormFile("file", name)
   if err != nil {
-    return err
+    return File{}, err
   }
 
-  _, err = io.Copy(fw, file)
+  _, err = io.Copy(fw, r)
   if err != nil {
-    return err
+    return File{}, err
   }
 
   err = w.Close()
   if err != nil {
-    return err
+    return File{}, err
   }
 
-  httpReq, err := http.NewRequest(
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
     http.MethodPost,
     "https://upload.box.com/api/2.0/files/content",
     body,
   )
   if err != nil {
-    return err
+    return File{}, err
   }
 
   httpReq.Header.Set("Content-Type", w.FormDataContentType())
 
   var resp UploadResponse
   err = c.makeRequest(httpReq, &resp)
-  return err
+  if err != nil {
+    return File{}, err
+  }
+
+  if len(resp.Entries) == 0 {
+    return File{}, errors.New("Box did not return the uploaded file")
+  }
+
+  return resp.Entries[0], nil
 }
 
-func (c *Client) chunkedUpload(folder Folder, file *os.File) error {
-  log.Println("Doing chunk upload")
+func (c *Client) uploadPart(ctx context.Context, sessionId string, part files.FilePart, size int64) (UploadPart, error) {
+  httpReq, err := http.NewRequestWithContext(
+    ctx,
+    http.MethodPut,
+    fmt.Sprintf("https://upload.box.com/api/2.0/files/upload_sessions/%s", sessionId),
+    bytes.NewBuffer(part.Data),
+  )
+  if err != nil {
+    return UploadPart{}, err
+  }
 
-  info, err := file.Stat()
+  base64encodedDigest := base64.StdEncoding.EncodeToString(part.Digest)
+
+  httpReq.Header.Set("content-type", "application/octet-stream")
+  httpReq.Header.Set(
+    "content-range",
+    fmt.Sprintf("bytes %d-%d/%d", part.Begin, part.End, size),
+  )
+  httpReq.Header.Set(
+    "digest",
+    fmt.Sprintf("sha=%s", base64encodedDigest),
+  )
+
+  logger := slog.With("session", sessionId, "offset", part.Begin, "size", len(part.Data))
+  logger.Debug("Uploading part")
+  rawUploadResp, err := c.httpClient.Do(httpReq)
   if err != nil {
-    return err
+    return UploadPart{}, err
+  }
+  defer rawUploadResp.Body.Close()
+  logger.Debug("Finished uploading part")
+
+  var uploadPartResponse UploadPartResponse
+  err = c.handleResponse(rawUploadResp, &uploadPartResponse)
+  if err != nil {
+    return UploadPart{}, err
   }
 
+  return uploadPartResponse.Part, nil
+}
+
+// uploadPartWithRetry sends a part again when box rate limits it, which
+// parallel parts of a large file run into
+func (c *Client) uploadPartWithRetry(ctx context.Context, sessionId string, part files.FilePart, size int64) (UploadPart, error) {
+  for attempt := 1; ; attempt++ {
+    uploadPart, err := c.uploadPart(ctx, sessionId, part, size)
+    if !IsRateLimited(err) || attempt > MAX_RATE_LIMIT_RETRIES {
+      return uploadPart, err
+    }
+
+    wait := time.Duration(attempt) * time.Second
+    var clientErr *ClientError
+    if errors.As(err, &clientErr) && clientErr.RetryAfter > 0 {
+      wait = clientErr.RetryAfter
+    }
+
+    slog.Debug("Part rate limited, retrying", "session", sessionId, "offset", part.Begin, "wait", wait)
+    select {
+    case <-ctx.Done():
+      return UploadPart{}, ctx.Err()
+    case <-time.After(wait):
+    }
+  }
+}
+
+func (c *Client) chunkedUpload(ctx context.Context, folder Folder, name string, r io.Reader, size int64) (File, error) {
+  slog.Debug("Doing chunk upload", "file", name, "size", size)
+
   createSessionReq := CreateUploadSessionRequest{
-    FileName: info.Name(),
-    FileSize: info.Size(),
+    FileName: name,
+    FileSize: size,
     FolderId: folder.Id,
   }
 
-  log.Println("Creating upload session")
-  createUploadSessionResponse, err := c.CreateUploadSession(createSessionReq)
+  slog.Debug("Creating upload session", "file", name)
+  createUploadSessionResponse, err := c.CreateUploadSession(ctx, createSessionReq)
   if err != nil {
-    return err
+    return File{}, err
   }
-  log.Println("Created upload session")
+  slog.Debug("Created upload session", "file", name, "session", createUploadSessionResponse.Id)
 
-  parts, err := files.ChunkFile(file, createUploadSessionResponse.PartSize)
+  file, err := c.uploadSession(ctx, createUploadSessionResponse, r, size, name)
   if err != nil {
-    return err
+    // Parts of an abandoned session would otherwise count against the
+    // storage until box expires the session
+    abortCtx, cancel := context.WithTimeout(context.Background(), ABORT_TIMEOUT)
+    defer cancel()
+
+    abortErr := c.AbortUploadSession(abortCtx, createUploadSessionResponse.Id)
+    if abortErr != nil {
+      slog.Warn("Error aborting upload session", "session", createUploadSessionResponse.Id, "error", abortErr)
+    } else {
+      slog.Debug("Aborted upload session", "session", createUploadSessionResponse.Id)
+    }
+    return File{}, err
   }
 
+  return file, nil
+}
+
+// uploadSession sends the parts of r to an open upload session and
+// commits it
+func (c *Client) uploadSession(ctx context.Context, createUploadSessionResponse CreateUploadSessionResponse, r io.Reader, size int64, name string) (File, error) {
+
+  // Hash the whole file while it is split into parts so the commit
+  // digest does not need a second pass over the data. Parts are read
+  // one at a time and uploaded while the next ones are read, with at
+  // most MAX_PARALLEL_PARTS held in memory.
+  fileHash := sha1.New()
+  source := io.TeeReader(r, fileHash)
+
+  var uploadedPartsMu sync.Mutex
   var uploadedParts []UploadPart
-  uploadChan := make(chan error)
-  for _, part := range parts {
+  update := progress.Update{
+    Name: name,
+    Total: size,
+    TotalParts: int((size + createUploadSessionResponse.PartSize - 1) / createUploadSessionResponse.PartSize),
+  }
+  c.reportProgress(update)
+  uploadChan := make(chan error, MAX_PARALLEL_PARTS)
+  inFlight := 0
+
+  var uploadErr error
+  for offset := int64(0); uploadErr == nil; {
+    if inFlight == MAX_PARALLEL_PARTS {
+      uploadErr = <- uploadChan
+      inFlight--
+      continue
+    }
+
+    if ctx.Err() != nil {
+      uploadErr = ctx.Err()
+      break
+    }
+
+    part, err := files.ReadPart(source, offset, createUploadSessionResponse.PartSize)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      uploadErr = err
+      break
+    }
+    offset += int64(len(part.Data))
+
+    inFlight++
     go func(part files.FilePart) {
-      httpReq, err := http.NewRequest(
-        http.MethodPut,
-        fmt.Sprintf("https://upload.box.com/api/2.0/files/upload_sessions/%s", createUploadSessionResponse.Id),
-        bytes.NewBuffer(part.Data),
-      )
-
-      base64encodedDigest := base64.StdEncoding.EncodeToString(part.Digest)
-
-      httpReq.Header.Set("content-type", "application/octet-stream")
-      httpReq.Header.Set(
-        "content-range",
-        fmt.Sprintf("bytes %d-%d/%d", part.Begin, part.End, info.Size()),
-      )
-      httpReq.Header.Set(
-        "digest",
-        fmt.Sprintf("sha=%s", base64encodedDigest),
-      )
-
-      log.Println("Uploading part " + base64encodedDigest)
-      rawUploadResp, err := c.httpClient.Do(httpReq)
+      uploadPart, err := c.uploadPartWithRetry(ctx, createUploadSessionResponse.Id, part, size)
       if err != nil {
         uploadChan <- err
+        return
       }
-      log.Println("Finished uploading part " + base64encodedDigest)
 
-      var uploadPartResponse UploadPartResponse
-      err = c.handleResponse(rawUploadResp, &uploadPartResponse)
-      if err != nil {
-        uploadChan <- err
-      }
+      uploadedPartsMu.Lock()
+      uploadedParts = append(uploadedParts, uploadPart)
+      update.Done += int64(len(part.Data))
+      update.Parts++
+      current := update
+      uploadedPartsMu.Unlock()
 
-      uploadedParts = append(uploadedParts, uploadPartResponse.Part)
+      c.reportProgress(current)
 
       uploadChan <- nil
     }(part)
   }
 
-  for i := 0; i < len(parts); i++ {
-    err = <- uploadChan
-    if err != nil {
-      return err
+  for ; inFlight > 0; inFlight-- {
+    err := <- uploadChan
+    if uploadErr == nil {
+      uploadErr = err
     }
   }
 
-  log.Println("Checking session state")
+  if uploadErr != nil {
+    return File{}, uploadErr
+  }
+
+  slog.Debug("Checking session state", "session", createUploadSessionResponse.Id)
 
   for {
-    getUploadSessionResponse, err := c.GetUploadSession(createUploadSessionResponse.Id)
+    getUploadSessionResponse, err := c.GetUploadSession(ctx, createUploadSessionResponse.Id)
     if err != nil {
-      return err
+      return File{}, err
     }
 
     processed := getUploadSessionResponse.NumPartsProcessed
@@ -410,30 +625,26 @@ func (c *Client) chunkedUpload(folder Folder, file *os.File) error {
       break
     }
 
-    log.Println(strconv.FormatInt(int64(processed), 10) + " processed out of " + strconv.FormatInt(int64(total), 10))
-    time.Sleep(1 * time.Second)
+    slog.Debug("Waiting for parts to be processed", "session", createUploadSessionResponse.Id, "processed", processed, "total", total)
+    select {
+    case <-ctx.Done():
+      return File{}, ctx.Err()
+    case <-time.After(1 * time.Second):
+    }
   }
 
-  log.Println("Session Ready!")
+  slog.Debug("Committing session", "session", createUploadSessionResponse.Id)
+  digest := base64.StdEncoding.EncodeToString(fileHash.Sum(nil))
 
-  log.Println("Committing session")
-  fileHash := sha1.New()
-  digestFile, err := os.Open(file.Name())
+  commitResp, err := c.CommitUploadSession(ctx, createUploadSessionResponse.Id, uploadedParts, digest)
   if err != nil {
-    return err
+    return File{}, err
   }
-  defer digestFile.Close()
+  slog.Debug("Committed session", "session", createUploadSessionResponse.Id)
 
-  if _, err := io.Copy(fileHash, digestFile); err != nil {
-    return err
+  if len(commitResp.Entries) == 0 {
+    return File{}, errors.New("Box did not return the committed file")
   }
-  digest := base64.StdEncoding.EncodeToString(fileHash.Sum(nil))
 
-  _, err = c.CommitUploadSession(createUploadSessionResponse.Id, uploadedParts, digest)
-  if err != nil {
-    return err
-  }
-  log.Println("Commited session")
-
-  return nil
+  return commitResp.Entries[0], nil
 }
@@ -0,0 +1,98 @@
+package box
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Error codes box returns that callers act on
+const CODE_ITEM_NAME_IN_USE = "item_name_in_use"
+
+// ClientError is a failed box API request
+type ClientError struct {
+  Type string `json:"type"`
+  Status int `json:"status"`
+  Code string `json:"code"`
+  ContextInfo json.RawMessage `json:"context_info"`
+  HelpUrl string `json:"help_url"`
+  Message string `json:"message"`
+  RequestId string `json:"request_id"`
+
+  // RetryAfter is how long box asked to wait before retrying a rate
+  // limited request
+  RetryAfter time.Duration `json:"-"`
+}
+
+func (e *ClientError) Error() string {
+  message := e.Message
+  if message == "" {
+    message = http.StatusText(e.Status)
+  }
+
+  if e.Code == "" {
+    return fmt.Sprintf("box: %s (status %d)", message, e.Status)
+  }
+
+  return fmt.Sprintf("box: %s (status %d, code %s)", message, e.Status, e.Code)
+}
+
+// Conflicts returns the items a conflict error is about, such as the
+// existing folder when creating one whose name is already taken
+func (e *ClientError) Conflicts() []Folder {
+  var info struct {
+    Conflicts json.RawMessage `json:"conflicts"`
+  }
+  if json.Unmarshal(e.ContextInfo, &info) != nil || len(info.Conflicts) == 0 {
+    return nil
+  }
+
+  // Folder creation lists the conflicts, uploads report a single item
+  var conflicts []Folder
+  if json.Unmarshal(info.Conflicts, &conflicts) == nil {
+    return conflicts
+  }
+
+  var conflict Folder
+  if json.Unmarshal(info.Conflicts, &conflict) == nil {
+    return []Folder{conflict}
+  }
+
+  return nil
+}
+
+func hasStatus(err error, status int) bool {
+  var clientErr *ClientError
+  return errors.As(err, &clientErr) && clientErr.Status == status
+}
+
+// IsNotFound reports whether the item a request was about does not exist
+func IsNotFound(err error) bool {
+  return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether a request clashed with an existing item
+func IsConflict(err error) bool {
+  return hasStatus(err, http.StatusConflict)
+}
+
+// IsRateLimited reports whether box turned a request down for being
+// sent too often
+func IsRateLimited(err error) bool {
+  return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsAuth reports whether a request failed because the credentials were
+// rejected, either by the API or when fetching a token
+func IsAuth(err error) bool {
+  var retrieveErr *oauth2.RetrieveError
+  if errors.As(err, &retrieveErr) {
+    return true
+  }
+
+  return hasStatus(err, http.StatusUnauthorized)
+}
@@ -1,15 +1,5 @@
 package box
 
-type ClientError struct {
-  Type string `json:"type"`
-  Status int64 `json:"status"`
-  Code string `json:"code"`
-  ContextInfo interface{} `json:"context_info"`
-  HelpUrl string `json:"help_url"`
-  Message string `json:"message"`
-  RequestId string `json:"request_id"`
-}
-
 type Folder struct {
   Id string `json:"id"`
   Type string `json:"type"`
@@ -20,6 +10,8 @@ type File struct {
   Id string `json:"id"`
   Type string `json:"type"`
   Name string `json:"name"`
+  Size int64 `json:"size"`
+  Sha1 string `json:"sha1"`
 }
 
 type SearchResponse struct {
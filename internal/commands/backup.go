@@ -4,22 +4,35 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
 	"time"
-  "sort"
 
 	"github.com/jdollar/backup/internal/box"
 	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/jdollar/backup/internal/hooks"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+	"github.com/jdollar/backup/internal/progress"
+	"github.com/jdollar/backup/internal/storage"
 	"github.com/urfave/cli/v2"
 )
 
 const OUTPUT_DIRECTORY_FLAG = "outputDirectory"
+const INCREMENTAL_FLAG = "incremental"
+const FULL_EVERY_FLAG = "fullEvery"
+const SNAPSHOT_FILE_FLAG = "snapshotFile"
+const FORCE_FLAG = "force"
+const VOLUME_SIZE_FLAG = "volume-size"
+const STREAM_FLAG = "stream"
 
 type RequiredStringField struct {
   Value string
@@ -79,16 +92,14 @@ func validateConfigValues(conf config.Configuration) error {
   return nil
 }
 
-func exportToBox(conf config.Configuration, file *os.File) error {
+func newBoxClient(ctx context.Context, conf config.Configuration) (box.Client, error) {
   // Validate config file to ensure we have
   // the required values
   err := validateConfigValues(conf)
   if err != nil {
-    return err
+    return box.Client{}, err
   }
 
-  ctx := context.Background()
-
   boxConf := conf.Box
   copts := box.ClientOpts{
     SubjectType: boxConf.SubjectType,
@@ -97,70 +108,95 @@ func exportToBox(conf config.Configuration, file *os.File) error {
     ClientSecret: boxConf.ClientSecret,
   }
 
-  client := box.NewClient(ctx, copts)
+  return box.NewClient(ctx, copts), nil
+}
 
-  log.Println("Looking for backup folder: " + boxConf.BackupFolderName)
-  searchResponse, err := client.SearchFolders(boxConf.BackupFolderName)
+// findFolder returns the box folder with the given name, or an empty
+// folder when it does not exist yet
+func findFolder(ctx context.Context, client *box.Client, name string) (box.Folder, error) {
+  slog.Debug("Looking for backup folder", "folder", name)
+  searchResponse, err := client.SearchFolders(ctx, name)
   if err != nil {
-    return err
+    return box.Folder{}, err
   }
 
-  var folder box.Folder
   for _, v := range searchResponse.Entries {
-    if v.Name == boxConf.BackupFolderName {
-      log.Println("Found backup folder")
-      folder = v
-      break
+    if v.Name == name {
+      slog.Debug("Found backup folder", "folder", name, "folder_id", v.Id)
+      return v, nil
     }
   }
 
+  return box.Folder{}, nil
+}
+
+func findOrCreateFolder(ctx context.Context, client *box.Client, name string) (box.Folder, error) {
+  folder, err := findFolder(ctx, client, name)
+  if err != nil {
+    return folder, err
+  }
+
   if folder == (box.Folder{}) {
-    log.Println("No backup folder found. Creating " + boxConf.BackupFolderName)
+    slog.Info("No backup folder found, creating it", "folder", name)
 
     createFolderReq := box.CreateFolderRequest{
-      Name: boxConf.BackupFolderName,
+      Name: name,
       Parent: box.Folder{
         Id: "0",
       },
     }
-    createResponse, err := client.CreateBackupFolder(createFolderReq)
+    createResponse, err := client.CreateBackupFolder(ctx, createFolderReq)
+    var clientErr *box.ClientError
+    if errors.As(err, &clientErr) && clientErr.Code == box.CODE_ITEM_NAME_IN_USE && len(clientErr.Conflicts()) > 0 {
+      // Search results lag behind, so a folder created moments ago, or
+      // by another job at the same time, can be missing from them
+      folder = clientErr.Conflicts()[0]
+      slog.Info("Backup folder already exists, using it", "folder", name, "folder_id", folder.Id)
+      return folder, nil
+    }
     if err != nil {
-      return err
+      return folder, err
     }
 
     folder = box.Folder(createResponse)
   }
 
-  log.Println("Uploading backup file to box")
-  // Upload the new backup file
-  err = client.Upload(folder, file)
+  return folder, nil
+}
+
+// cleanupBackend removes the oldest backups of job stored in a backend
+// until at most limit remain, treating split archives as a single
+// backup. Backups of other jobs sharing the backend are left alone.
+func cleanupBackend(ctx context.Context, logger *slog.Logger, backend storage.Backend, job string, limit int64) error {
+  objects, err := backend.List(ctx)
   if err != nil {
     return err
   }
-  log.Println("Finished backing up file to box")
 
-  log.Println("Cleaning up old backups")
-  // Grab all the files now in the folder
-  listResp, err := client.ListItemsInFolder(
-    folder,
-    999,
-    0,
-  )
-  if err != nil {
-    return err
+  var names []string
+  for _, object := range objects {
+    names = append(names, object.Name)
   }
 
-  if int64(len(listResp.Entries)) > conf.BackupLimit {
-    filesToRemove := listResp.Entries[conf.BackupLimit:]
+  backups, members := groupBackups(names)
+  toRemove, keptChain := backupsToRemove(jobBackups(backups, job), limit)
+  if keptChain {
+    logger.Warn("The current incremental chain is longer than the backup limit, keeping all of it", "limit", limit)
+  }
+  if len(toRemove) == 0 {
+    logger.Debug("No backups to remove")
+    return nil
+  }
 
-    for _, fileToRemove := range filesToRemove {
-      err := client.DeleteFile(fileToRemove)
+  for _, backup := range toRemove {
+    for _, name := range members[backup] {
+      logger.Info("Removing old backup", "archive", name)
+      err := backend.Remove(ctx, name)
       if err != nil {
         return err
       }
     }
   }
-  log.Println("Finished cleaning old backups")
 
   return nil
 }
@@ -171,35 +207,17 @@ func (a ByName) Len() int           { return len(a) }
 func (a ByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByName) Less(i, j int) bool { return a[i] < a[j] }
 
-func fileSystemCleanup(conf config.Configuration, outputPath string) error {
-  filenames, err := filepath.Glob(outputPath + "/*.tar.gz")
+func fileSystemCleanup(ctx context.Context, logger *slog.Logger, outputPath string, job string, limit int64) error {
+  backend, err := storage.NewLocal(outputPath)
   if err != nil {
     return err
   }
 
-  numberToRemove := int64(len(filenames)) - conf.BackupLimit
-  if numberToRemove <= 0 {
-    log.Println("No files to remove for local backup")
-    return nil
-  }
-
-  sort.Sort(ByName(filenames))
-
-  filesToRemove := filenames[:numberToRemove]
-
-  for _, filename := range filesToRemove {
-    log.Println("Removing " + filename)
-    err := os.Remove(filename)
-    if err != nil {
-      return  err
-    }
-  }
-
-  return nil
+  return cleanupBackend(ctx, logger.With("destination", "local"), backend, job, limit)
 }
 
 func addToArchive(tw *tar.Writer, filename string, file io.Reader, info os.FileInfo) error {
-  log.Println("Adding " + filename)
+  slog.Debug("Adding file to archive", "file", filename)
   header, err := tar.FileInfoHeader(info, info.Name())
   if err != nil {
     return err
@@ -220,38 +238,87 @@ func addToArchive(tw *tar.Writer, filename string, file io.Reader, info os.FileI
   return nil
 }
 
-func addFilesToArchive(tw *tar.Writer, files []string) error {
+func addMetaToArchive(tw *tar.Writer, meta archiveMeta) error {
+  data, err := json.Marshal(meta)
+  if err != nil {
+    return err
+  }
+
+  header := &tar.Header{
+    Name: ARCHIVE_META_NAME,
+    Mode: 0644,
+    Size: int64(len(data)),
+    ModTime: time.Now(),
+    Typeflag: tar.TypeReg,
+  }
+
+  err = tw.WriteHeader(header)
+  if err != nil {
+    return err
+  }
+
+  _, err = tw.Write(data)
+  return err
+}
+
+type archiveFile struct {
+  Name string
+  Info os.FileInfo
+}
+
+// isExcluded matches a path against exclude patterns. Patterns without
+// a separator match the base name anywhere in the tree, as in *.log.
+func isExcluded(filename string, excludes []string) bool {
+  for _, pattern := range excludes {
+    if matched, _ := filepath.Match(pattern, filename); matched {
+      return true
+    }
+
+    if !strings.ContainsRune(pattern, filepath.Separator) {
+      if matched, _ := filepath.Match(pattern, filepath.Base(filename)); matched {
+        return true
+      }
+    }
+  }
+
+  return false
+}
+
+// collectFiles expands the globs and directories passed on the command
+// line into the list of regular files to back up, leaving out anything
+// matching an exclude pattern
+func collectFiles(files []string, excludes []string) ([]archiveFile, error) {
+  var collected []archiveFile
+
   for _, filenameOrGlob := range files {
     filenames, err := filepath.Glob(filenameOrGlob)
     if err != nil {
-      return err
+      return collected, err
     }
 
     if len(filenames) <= 0 {
-      return errors.New("No files found for backup")
+      return collected, errors.New("No files found for backup")
     }
 
     for _, filename := range filenames {
-      file, err := os.Open(filename)
-      if err != nil {
-        return err
+      if isExcluded(filename, excludes) {
+        continue
       }
-      defer file.Close()
 
-      info, err := file.Stat()
+      info, err := os.Stat(filename)
       if err != nil {
-        return err
+        return collected, err
       }
 
       if !info.IsDir() {
-        err = addToArchive(tw, filename, file, info)
-        if err != nil {
-          return err
-        }
+        collected = append(collected, archiveFile{
+          Name: filename,
+          Info: info,
+        })
       } else {
         dirFiles, err:= ioutil.ReadDir(filename)
         if err != nil {
-          return err
+          return collected, err
         }
 
         var dirFileNames []string
@@ -266,115 +333,729 @@ func addFilesToArchive(tw *tar.Writer, files []string) error {
         }
 
         if len(dirFileNames) > 0 {
-          err = addFilesToArchive(tw, dirFileNames)
+          dirCollected, err := collectFiles(dirFileNames, excludes)
           if err != nil {
-            return err
+            return collected, err
           }
+
+          collected = append(collected, dirCollected...)
         }
       }
     }
   }
 
-  return nil
+  return collected, nil
 }
 
-func createArchive(files []string, buf io.Writer) error {
-  gw := gzip.NewWriter(buf)
-  defer gw.Close()
-  tw := tar.NewWriter(gw)
-  defer tw.Close()
+// archiveStats describes what went into an archive
+type archiveStats struct {
+  Files int
+  Bytes int64
+  CompressTime time.Duration
+}
+
+// timedWriter adds up the time spent writing to w. Around the gzip
+// writer this is the compression time, along with writing the
+// compressed output.
+type timedWriter struct {
+  w io.Writer
+  elapsed *time.Duration
+}
+
+func (t timedWriter) Write(p []byte) (int, error) {
+  started := time.Now()
+  n, err := t.w.Write(p)
+  *t.elapsed += time.Since(started)
+  return n, err
+}
 
-  err := addFilesToArchive(tw, files)
+func addFileToArchive(ctx context.Context, tw *tar.Writer, f archiveFile, update progress.Update, report progress.Func) error {
+  file, err := os.Open(f.Name)
   if err != nil {
     return err
   }
+  defer file.Close()
 
-  return nil
+  update.File = f.Name
+  return addToArchive(tw, f.Name, progress.NewReader(files.NewContextReader(ctx, file), update, report), f.Info)
 }
 
-func moveFile(oldFileName string, newFileName string) error {
-  oldFile, err := os.Open(oldFileName)
+// createArchive writes the files into a gzipped tarball. A non nil meta
+// is written as the first entry so restores can find the chain an
+// incremental archive belongs to without reading all of it. report,
+// when set, follows the bytes read from the files. Cancelling ctx stops
+// the archive partway through with the context's error.
+func createArchive(ctx context.Context, files []archiveFile, meta *archiveMeta, level int, buf io.Writer, stats *archiveStats, report progress.Func) error {
+  gw, err := gzip.NewWriterLevel(buf, level)
   if err != nil {
     return err
   }
+  tw := tar.NewWriter(timedWriter{w: gw, elapsed: &stats.CompressTime})
+
+  if meta != nil {
+    err = addMetaToArchive(tw, *meta)
+    if err != nil {
+      return err
+    }
+  }
+
+  var update progress.Update
+  for _, f := range files {
+    update.Total += f.Info.Size()
+  }
+
+  for _, f := range files {
+    err := addFileToArchive(ctx, tw, f, update, report)
+    if err != nil {
+      return err
+    }
+
+    stats.Files++
+    stats.Bytes += f.Info.Size()
+    update.Done += f.Info.Size()
+  }
 
-  newFile, err := os.Create(newFileName)
+  // Reading the last byte finishes the progress, sources without any
+  // bytes never get there
+  if report != nil && update.Total == 0 {
+    report(progress.Update{
+      Done: 1,
+      Total: 1,
+    })
+  }
+
+  // Closing writes the tar and gzip trailers, an archive missing them
+  // is truncated
+  err = tw.Close()
   if err != nil {
     return err
   }
-  defer newFile.Close()
 
-  _, err = io.Copy(newFile, oldFile)
-  oldFile.Close()
+  started := time.Now()
+  err = gw.Close()
+  stats.CompressTime += time.Since(started)
+  return err
+}
+
+// createSingleArchive builds the archive in a hidden temporary file in
+// the output directory and renames it into place once it is complete.
+// The archive bytes are also written to stream when it is set.
+func createSingleArchive(ctx context.Context, files []archiveFile, meta *archiveMeta, level int, outputDirectory string, outputFileName string, stream io.Writer, stats *archiveStats, report progress.Func) ([]string, error) {
+  // create output file
+  outputPath := filepath.Join(
+    outputDirectory,
+    outputFileName,
+  )
+
+  tmpOut, err := ioutil.TempFile(outputDirectory, "." + outputFileName + ".*")
   if err != nil {
-    return err
+    return nil, err
   }
 
-  err = os.Remove(oldFileName)
+  var out io.Writer = tmpOut
+  if stream != nil {
+    out = io.MultiWriter(tmpOut, stream)
+  }
+
+  err = createArchive(ctx, files, meta, level, out, stats, report)
   if err != nil {
-    return err
+    tmpOut.Close()
+    os.Remove(tmpOut.Name())
+    return nil, err
   }
 
-  return nil
+  // Temp files are private, keep the permissions archives had when
+  // they were copied into place
+  err = tmpOut.Chmod(0644)
+  if err != nil {
+    tmpOut.Close()
+    os.Remove(tmpOut.Name())
+    return nil, err
+  }
+
+  err = tmpOut.Close()
+  if err != nil {
+    os.Remove(tmpOut.Name())
+    return nil, err
+  }
+
+  err = os.Rename(tmpOut.Name(), outputPath)
+  if err != nil {
+    os.Remove(tmpOut.Name())
+    return nil, err
+  }
+
+  return []string{outputPath}, nil
 }
 
-func boxCommandAction(conf config.Configuration, c *cli.Context) error {
-  outputDirectory := c.String(OUTPUT_DIRECTORY_FLAG)
+// createVolumes builds the archive as numbered volumes of at most
+// volumeSize bytes plus a manifest holding their checksums
+func createVolumes(ctx context.Context, files []archiveFile, meta *archiveMeta, level int, outputDirectory string, outputFileName string, volumeSize int64, stats *archiveStats, report progress.Func) ([]string, error) {
+  tmpDir, err := ioutil.TempDir(outputDirectory, "." + outputFileName + ".*")
+  if err != nil {
+    return nil, err
+  }
+  defer os.RemoveAll(tmpDir)
+
+  vw := newVolumeWriter(tmpDir, outputFileName, volumeSize)
+  err = createArchive(ctx, files, meta, level, vw, stats, report)
+  if err != nil {
+    vw.Close()
+    return nil, err
+  }
+
+  tmpPaths, err := vw.Close()
+  if err != nil {
+    return nil, err
+  }
+
+  var outputPaths []string
+  for _, tmpPath := range tmpPaths {
+    outputPath := filepath.Join(outputDirectory, filepath.Base(tmpPath))
+    err = os.Rename(tmpPath, outputPath)
+    if err != nil {
+      return nil, err
+    }
+
+    outputPaths = append(outputPaths, outputPath)
+  }
+
+  slog.Info("Split archive into volumes", "archive", outputFileName, "volumes", len(tmpPaths) - 1)
+
+  return outputPaths, nil
+}
+
+type backupOptions struct {
+  Job string
+  OutputDirectory string
+  Sources []string
+  Excludes []string
+  CompressionLevel int
+  Destinations []string
+  BackupLimit int64
+  Incremental bool
+  FullEvery int
+  SnapshotFile string
+  FingerprintFile string
+  Force bool
+  VolumeSize int64
+  Stream bool
+  Notify config.NotifyConfiguration
+  Lock lockOptions
+}
+
+// logger returns the logger for a backup run, tagged with the job when
+// the run belongs to one
+func (o backupOptions) logger() *slog.Logger {
+  return jobLogger(o.Job)
+}
+
+func jobLogger(job string) *slog.Logger {
+  if job == "" {
+    return slog.Default()
+  }
+
+  return slog.With("job", job)
+}
+
+// compressionLevel maps the compression names used in the config to
+// gzip levels. Archives stay gzip streams even with none so they keep
+// the same name and format.
+func compressionLevel(name string) (int, error) {
+  switch name {
+  case "", "default":
+    return gzip.DefaultCompression, nil
+  case "none":
+    return gzip.NoCompression, nil
+  case "fast":
+    return gzip.BestSpeed, nil
+  case "best":
+    return gzip.BestCompression, nil
+  }
+
+  return 0, errors.New("Invalid compression " + name + ", expected none, fast, default or best")
+}
+
+func backupOptionsFromJob(conf config.Configuration, name string, job config.JobConfiguration) (backupOptions, error) {
+  if job.OutputDirectory == "" {
+    return backupOptions{}, errors.New("Missing output_directory for job " + name)
+  }
+
+  if len(job.Sources) == 0 {
+    return backupOptions{}, errors.New("Missing sources for job " + name)
+  }
+
+  level, err := compressionLevel(job.Compression)
+  if err != nil {
+    return backupOptions{}, err
+  }
+
+  opts := backupOptions{
+    Job: name,
+    OutputDirectory: job.OutputDirectory,
+    Sources: job.Sources,
+    Excludes: job.Excludes,
+    CompressionLevel: level,
+    Destinations: job.Destinations,
+    BackupLimit: job.BackupLimit,
+    Incremental: job.Incremental,
+    FullEvery: job.FullEvery,
+    Stream: job.Stream,
+    Notify: conf.Notify,
+    // Jobs may share an output directory, so their state is kept apart
+    SnapshotFile: filepath.Join(job.OutputDirectory, name + "-snapshot.json"),
+    FingerprintFile: filepath.Join(job.OutputDirectory, name + "-fingerprint.json"),
+  }
+
+  if len(opts.Destinations) == 0 {
+    opts.Destinations = []string{BOX_DESTINATION}
+  }
+
+  if opts.BackupLimit == 0 {
+    opts.BackupLimit = conf.BackupLimit
+  }
+
+  if opts.FullEvery == 0 {
+    opts.FullEvery = 7
+  }
+
+  // Retention never breaks up the current chain, a limit below its
+  // length would keep more backups than configured
+  if opts.Incremental {
+    if opts.BackupLimit > 0 && opts.BackupLimit < int64(opts.FullEvery) {
+      return opts, errors.New("Job " + name + " has a backup_limit below full_every, it has to keep a whole incremental chain")
+    }
+
+    for _, destination := range opts.Destinations {
+      limit := destinationLimit(conf, destination, opts.BackupLimit)
+      if limit > 0 && limit < int64(opts.FullEvery) {
+        return opts, errors.New("Destination " + destination + " of job " + name + " has a backup_limit below full_every, it has to keep a whole incremental chain")
+      }
+    }
+  }
+
+  if job.Notify != nil {
+    opts.Notify = *job.Notify
+  }
+
+  err = checkNotifiers(conf, opts.Notify)
+  if err != nil {
+    return opts, err
+  }
+
+  lockConf := conf.Lock
+  if job.Lock != nil {
+    lockConf = *job.Lock
+  }
+  opts.Lock, err = lockOptionsFromConfig(lockConf)
+  if err != nil {
+    return opts, err
+  }
+
+  if job.VolumeSize != "" {
+    opts.VolumeSize, err = parseByteSize(job.VolumeSize)
+    if err != nil {
+      return opts, err
+    }
+  }
+
+  return opts, nil
+}
+
+func backupOptionsFromContext(conf config.Configuration, c *cli.Context) (backupOptions, error) {
+  opts := backupOptions{
+    OutputDirectory: c.String(OUTPUT_DIRECTORY_FLAG),
+    Sources: c.Args().Slice(),
+    CompressionLevel: gzip.DefaultCompression,
+    Destinations: []string{BOX_DESTINATION},
+    BackupLimit: conf.BackupLimit,
+    Incremental: c.Bool(INCREMENTAL_FLAG),
+    FullEvery: c.Int(FULL_EVERY_FLAG),
+    SnapshotFile: c.String(SNAPSHOT_FILE_FLAG),
+    FingerprintFile: filepath.Join(c.String(OUTPUT_DIRECTORY_FLAG), "fingerprint.json"),
+    Force: c.Bool(FORCE_FLAG),
+    Stream: c.Bool(STREAM_FLAG),
+    Notify: conf.Notify,
+  }
+
+  if opts.SnapshotFile == "" {
+    opts.SnapshotFile = filepath.Join(opts.OutputDirectory, "snapshot.json")
+  }
+
+  err := checkNotifiers(conf, opts.Notify)
+  if err != nil {
+    return opts, err
+  }
+
+  opts.Lock, err = lockOptionsFromConfig(conf.Lock)
+  if err != nil {
+    return opts, err
+  }
+
+  if volumeSize := c.String(VOLUME_SIZE_FLAG); volumeSize != "" {
+    size, err := parseByteSize(volumeSize)
+    if err != nil {
+      return opts, err
+    }
+
+    opts.VolumeSize = size
+  }
+
+  return opts, nil
+}
+
+// archiveResult is a built archive. Streamed holds the objects the
+// destinations it was streamed to stored.
+type archiveResult struct {
+  Name string
+  Paths []string
+  Streamed map[string]storage.Object
+  Fingerprint *fingerprintState
+  Skipped bool
+  Stats archiveStats
+}
+
+// buildArchive creates the backup archive in the output directory. With
+// rcon configured, world saving stays off for as long as the sources are
+// being read.
+func buildArchive(ctx context.Context, conf config.Configuration, opts backupOptions) (archiveResult, error) {
+  var result archiveResult
+
+  outputDirectory := opts.OutputDirectory
   err := os.MkdirAll(outputDirectory, os.ModePerm)
   if err != nil {
-    return err
+    return result, withExitCode(EXIT_ARCHIVE, err)
   }
 
-  currentTimeUnix := time.Now().UTC().UnixMilli()
+  if conf.Rcon.Host != "" {
+    resume, err := pauseWorldSaving(conf.Rcon)
+    if err != nil {
+      return result, withExitCode(EXIT_SOURCE, err)
+    }
+    defer resume()
+  }
 
-  outputFileName := strconv.FormatInt(currentTimeUnix, 10) + ".tar.gz"
+  sources, err := collectFiles(opts.Sources, opts.Excludes)
+  if err != nil {
+    return result, withExitCode(EXIT_SOURCE, err)
+  }
 
-  // create output file
-  outputPath := filepath.Join(
-    c.String(OUTPUT_DIRECTORY_FLAG),
-    outputFileName,
-  )
+  previousFingerprint, err := loadFingerprintState(opts.FingerprintFile)
+  if err != nil {
+    return result, withExitCode(EXIT_ARCHIVE, err)
+  }
 
-  tmpOut, err := ioutil.TempFile("", outputFileName)
+  fingerprint, err := fingerprintSources(previousFingerprint, sources)
   if err != nil {
-    log.Fatal("Error backing up files:", err)
+    return result, withExitCode(EXIT_SOURCE, err)
+  }
+  result.Fingerprint = fingerprint
+
+  // An idle server would otherwise upload an identical archive and
+  // rotate a real backup out of the history
+  if !opts.Force && previousFingerprint != nil && previousFingerprint.Fingerprint == fingerprint.Fingerprint {
+    opts.logger().Info("Nothing changed since the last backup, skipping", "archive", previousFingerprint.Archive)
+    result.Skipped = true
+    return result, nil
   }
 
-  filenames := c.Args().Slice()
-  err = createArchive(filenames, tmpOut)
+  created := time.Now()
+
+  outputFileName := backupArchiveName(opts.Job, created, FULL_ARCHIVE_SUFFIX)
+  filesToArchive := sources
+
+  var plan incrementalPlan
+  var meta *archiveMeta
+  if opts.Incremental {
+    previous, err := loadSnapshotIndex(opts.SnapshotFile)
+    if err != nil {
+      return result, withExitCode(EXIT_ARCHIVE, err)
+    }
+
+    full := needsFullBackup(previous, outputDirectory, opts.FullEvery)
+    plan, err = planIncremental(previous, full, sources)
+    if err != nil {
+      return result, withExitCode(EXIT_ARCHIVE, err)
+    }
+
+    if full {
+      opts.logger().Info("Starting new incremental chain with a full backup", "archive", outputFileName)
+      plan.Index.Base = outputFileName
+    } else {
+      outputFileName = backupArchiveName(opts.Job, created, INCREMENTAL_ARCHIVE_SUFFIX)
+      opts.logger().Info(
+        "Incremental backup",
+        "archive", outputFileName,
+        "parent", previous.Parent,
+        "changed", len(plan.Files),
+        "deleted", len(plan.Deleted),
+      )
+
+      plan.Index.Base = previous.Base
+      plan.Index.Level = previous.Level + 1
+      meta = &archiveMeta{
+        Type: "incremental",
+        Base: previous.Base,
+        Parent: previous.Parent,
+        Deleted: plan.Deleted,
+      }
+    }
+
+    plan.Index.Parent = outputFileName
+    filesToArchive = plan.Files
+  }
+
+  report := func(update progress.Update) {
+    update.Name = outputFileName
+    progress.Default().Update(update)
+  }
+
+  var outputPaths []string
+  if opts.VolumeSize > 0 {
+    outputPaths, err = createVolumes(ctx, filesToArchive, meta, opts.CompressionLevel, outputDirectory, outputFileName, opts.VolumeSize, &result.Stats, report)
+  } else if opts.Stream {
+    stream := startArchiveStream(ctx, conf, opts, outputFileName)
+    outputPaths, err = createSingleArchive(ctx, filesToArchive, meta, opts.CompressionLevel, outputDirectory, outputFileName, stream, &result.Stats, report)
+    result.Streamed = stream.finish(ctx, err)
+  } else {
+    outputPaths, err = createSingleArchive(ctx, filesToArchive, meta, opts.CompressionLevel, outputDirectory, outputFileName, nil, &result.Stats, report)
+  }
   if err != nil {
-    log.Fatal("Error backing up files:", err)
+    return result, withExitCode(EXIT_ARCHIVE, err)
   }
 
-  err = tmpOut.Close()
+  if opts.Incremental {
+    err = saveSnapshotIndex(opts.SnapshotFile, plan.Index)
+    if err != nil {
+      return result, withExitCode(EXIT_ARCHIVE, err)
+    }
+  }
+
+  result.Name = outputFileName
+  result.Paths = outputPaths
+  fingerprint.Archive = outputFileName
+
+  return result, nil
+}
+
+// runBackup archives the sources and exports the archive to the job's
+// destinations, running the configured hooks around each stage.
+// Failed uploads are queued and only warned about, the run succeeds
+// since the archive is safe in the output directory. Uploads the job
+// queued in earlier runs are retried first when due.
+// The job's lock is held throughout so overlapping runs never prune
+// twice.
+func runBackup(ctx context.Context, conf config.Configuration, opts backupOptions) error {
+  runner, err := newHookRunner(conf.Hooks)
   if err != nil {
-    return err
+    return withExitCode(EXIT_CONFIG, err)
   }
 
-  err = moveFile(tmpOut.Name(), outputPath)
+  held, err := acquireJobLock(ctx, conf, opts)
+  if err == errLockSkipped {
+    return nil
+  }
   if err != nil {
     return err
   }
+  defer held.release(ctx, opts.logger())
 
-  outputFile, err := os.Open(outputPath)
+  err = drainJobUploads(ctx, conf, opts.Job)
   if err != nil {
-    log.Fatal("Error exporting file:", err)
+    opts.logger().Error("Error retrying queued uploads", logging.Err(err))
+  }
+
+  env := hooks.Env{
+    Job: opts.Job,
+    Status: "running",
+  }
+
+  // One-shot runs start with empty metrics, a failure would otherwise
+  // leave a textfile without the last success
+  if conf.Metrics.TextfileDirectory != "" {
+    seedErr := seedLastSuccessMetrics([]string{opts.Job})
+    if seedErr != nil {
+      opts.logger().Warn("Error reading last successful run from the history", logging.Err(seedErr))
+    }
+  }
+
+  started := time.Now()
+  results, err := runBackupStages(ctx, conf, opts, runner, &env)
+  recordRun(opts.Job, runOutcome(env, err))
+  notifyRun(conf, opts, env, results, time.Since(started), err)
+  recordHistory(opts, env, results, started, err)
+  if metricsErr := writeMetricsTextfile(conf, opts.Job); metricsErr != nil {
+    opts.logger().Error("Error writing metrics textfile", logging.Err(metricsErr))
   }
-  defer outputFile.Close()
 
-  err = fileSystemCleanup(conf, c.String(OUTPUT_DIRECTORY_FLAG))
   if err != nil {
+    env.Status = "failure"
+    env.Error = err.Error()
+    // Failure hooks still run after an interrupt, bounded by the hook timeout.
+    runner.Run(context.WithoutCancel(ctx), hooks.ON_FAILURE, env)
     return err
   }
 
+  return nil
+}
 
-  log.Println(outputPath)
-  err = exportToBox(conf, outputFile)
+func runBackupStages(ctx context.Context, conf config.Configuration, opts backupOptions, runner hooks.Runner, env *hooks.Env) ([]destinationResult, error) {
+  err := runner.Run(ctx, hooks.PRE_ARCHIVE, *env)
   if err != nil {
-    log.Fatal("Error exporting file:", err)
+    return nil, err
   }
 
-  return nil
+  started := time.Now()
+  result, err := buildArchive(ctx, conf, opts)
+  if err != nil {
+    return nil, fmt.Errorf("Error backing up files: %w", err)
+  }
+
+  // The post hooks still run so whatever the pre_archive hooks paused
+  // is resumed, BACKUP_STATUS tells them nothing was archived
+  if result.Skipped {
+    env.Status = "skipped"
+    err = runner.Run(ctx, hooks.POST_ARCHIVE, *env)
+    if err != nil {
+      return nil, err
+    }
+
+    return nil, runner.Run(ctx, hooks.POST_UPLOAD, *env)
+  }
+
+  recordPhase(opts.Job, ARCHIVE_PHASE, "", time.Since(started) - result.Stats.CompressTime)
+  recordPhase(opts.Job, COMPRESS_PHASE, "", result.Stats.CompressTime)
+  metrics.Default.Set(FILES_METRIC, float64(result.Stats.Files), "job", opts.Job)
+  metrics.Default.Set(ARCHIVED_BYTES_METRIC, float64(result.Stats.Bytes), "job", opts.Job)
+
+  env.ArchiveName = result.Name
+  env.ArchivePath = filepath.Join(opts.OutputDirectory, result.Name)
+  // A split archive has no file of its own, the manifest lists its
+  // volumes
+  if opts.VolumeSize > 0 {
+    env.ArchivePath += VOLUME_MANIFEST_SUFFIX
+  }
+  env.ArchiveSize, err = pathsSize(result.Paths)
+  if err != nil {
+    return nil, err
+  }
+  metrics.Default.Set(ARCHIVE_SIZE_METRIC, float64(env.ArchiveSize), "job", opts.Job)
+
+  env.Status = "archived"
+  err = runner.Run(ctx, hooks.POST_ARCHIVE, *env)
+  if err != nil {
+    return nil, err
+  }
+
+  started = time.Now()
+  err = fileSystemCleanup(ctx, opts.logger(), opts.OutputDirectory, opts.Job, opts.BackupLimit)
+  if err != nil {
+    return nil, err
+  }
+  recordPhase(opts.Job, PRUNE_PHASE, "local", time.Since(started))
+
+  err = runner.Run(ctx, hooks.PRE_UPLOAD, *env)
+  if err != nil {
+    return nil, err
+  }
+
+  // Streamed destinations already hold the archive, the export only
+  // uploads it where streaming failed or was not possible
+  opts.logger().Info("Created archive", "archive", result.Name, "path", env.ArchivePath, "size", env.ArchiveSize)
+  results := exportToDestinations(ctx, conf, opts)
+  for i, destResult := range results {
+    if object, ok := result.Streamed[destResult.Name]; ok {
+      results[i].Objects = append([]storage.Object{object}, destResult.Objects...)
+    }
+  }
+  for _, destResult := range results {
+    for _, object := range destResult.Objects {
+      env.DestinationFileIds = append(env.DestinationFileIds, object.Id)
+    }
+  }
+
+  // Failed destinations are queued and retried by later runs, the
+  // archive is safe in the output directory until then
+  env.Status = "success"
+  err = destinationsError(opts.logger(), results)
+  if err != nil {
+    opts.logger().Warn("Upload failed, it will be retried later", logging.Err(err))
+    env.Status = "queued"
+  }
+
+  err = recordUploadResults(conf, opts, results)
+  if err != nil {
+    return results, err
+  }
+
+  err = saveFingerprintState(opts.FingerprintFile, result.Fingerprint)
+  if err != nil {
+    return results, err
+  }
+
+  return results, runner.Run(ctx, hooks.POST_UPLOAD, *env)
+}
+
+func pathsSize(paths []string) (int64, error) {
+  var size int64
+  for _, path := range paths {
+    info, err := os.Stat(path)
+    if err != nil {
+      return size, err
+    }
+    size += info.Size()
+  }
+
+  return size, nil
+}
+
+func boxCommandAction(conf config.Configuration, c *cli.Context) error {
+  opts, err := backupOptionsFromContext(conf, c)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  return runBackup(c.Context, conf, opts)
+}
+
+// backupFlags are shared by every command that runs a backup of the
+// files given as arguments
+func backupFlags() []cli.Flag {
+  return []cli.Flag{
+    &cli.StringFlag{
+      Name: OUTPUT_DIRECTORY_FLAG,
+      Aliases: []string{"o"},
+      Usage: "Path to where we will shove output",
+      Required: true,
+    },
+    &cli.BoolFlag{
+      Name: INCREMENTAL_FLAG,
+      Aliases: []string{"i"},
+      Usage: "Only archive files changed since the previous backup",
+    },
+    &cli.IntFlag{
+      Name: FULL_EVERY_FLAG,
+      Usage: "Start a new chain with a full backup after this many backups in incremental mode",
+      Value: 7,
+    },
+    &cli.StringFlag{
+      Name: SNAPSHOT_FILE_FLAG,
+      Usage: "Path to the incremental snapshot index (defaults to snapshot.json in the output directory)",
+    },
+    &cli.BoolFlag{
+      Name: FORCE_FLAG,
+      Aliases: []string{"f"},
+      Usage: "Create and upload a backup even if nothing changed since the last one",
+    },
+    &cli.StringFlag{
+      Name: VOLUME_SIZE_FLAG,
+      Usage: "Split the archive into volumes of at most this size (e.g. 4G)",
+    },
+    &cli.BoolFlag{
+      Name: STREAM_FLAG,
+      Usage: "Upload to destinations while the archive is written",
+    },
+  }
 }
 
 func NewBackupCommand(conf config.Configuration) *cli.Command {
@@ -385,15 +1066,7 @@ func NewBackupCommand(conf config.Configuration) *cli.Command {
   return &cli.Command{
     Name: "box",
     Usage: "Command to backup to dropbox",
-    Flags: []cli.Flag{
-      &cli.StringFlag{
-        Name: OUTPUT_DIRECTORY_FLAG,
-        Aliases: []string{"o"},
-        Usage: "Path to where we will shove output",
-        Required: true,
-      },
-    },
+    Flags: backupFlags(),
     Action: commandAction,
   }
 }
-
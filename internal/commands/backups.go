@@ -0,0 +1,319 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/box"
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/storage"
+)
+
+var errBackupNotFound = errors.New("backup not found")
+
+// BACKUP_JOB_SEPARATOR separates the job from the creation time in the
+// names of backups that belong to a job
+const BACKUP_JOB_SEPARATOR = "-"
+
+// backupLocator resolves a backup name to its contents. Names that
+// exist on the local filesystem are opened directly, anything else is
+// looked up in the box backup folder. Files downloaded from box are
+// kept until Close, so reading a backup twice only downloads it once.
+type backupLocator struct {
+  ctx context.Context
+  conf config.Configuration
+  box *storage.Box
+  downloadDir string
+  downloads map[string]string
+}
+
+func newBackupLocator(ctx context.Context, conf config.Configuration) *backupLocator {
+  return &backupLocator{
+    ctx: ctx,
+    conf: conf,
+  }
+}
+
+func (l *backupLocator) boxBackend() (*storage.Box, error) {
+  if l.box != nil {
+    return l.box, nil
+  }
+
+  client, err := newBoxClient(l.ctx, l.conf)
+  if err != nil {
+    return nil, err
+  }
+
+  folder, err := findFolder(l.ctx, &client, l.conf.Box.BackupFolderName)
+  if err != nil {
+    return nil, err
+  }
+
+  if folder == (box.Folder{}) {
+    return nil, errors.New("No backup folder found in box named " + l.conf.Box.BackupFolderName)
+  }
+
+  l.box = storage.NewBox(&client, folder)
+
+  return l.box, nil
+}
+
+// openFile opens a single file, locally or from box
+func (l *backupLocator) openFile(name string) (io.ReadCloser, error) {
+  if _, err := os.Stat(name); err == nil {
+    return os.Open(name)
+  }
+
+  baseName := filepath.Base(name)
+  if path, ok := l.downloads[baseName]; ok {
+    return os.Open(path)
+  }
+
+  path, err := l.download(baseName)
+  if err != nil {
+    return nil, err
+  }
+
+  return os.Open(path)
+}
+
+// download copies a file from box into the download directory
+func (l *backupLocator) download(name string) (string, error) {
+  backend, err := l.boxBackend()
+  if err != nil {
+    return "", err
+  }
+
+  r, err := backend.Open(l.ctx, name)
+  if errors.Is(err, storage.ErrNotFound) {
+    return "", errBackupNotFound
+  }
+  if err != nil {
+    return "", err
+  }
+  defer r.Close()
+
+  if l.downloadDir == "" {
+    l.downloadDir, err = ioutil.TempDir("", "backup-download-")
+    if err != nil {
+      return "", err
+    }
+    l.downloads = map[string]string{}
+  }
+
+  slog.Info("Downloading from box", "archive", name)
+  path := filepath.Join(l.downloadDir, name)
+  file, err := os.Create(path)
+  if err != nil {
+    return "", err
+  }
+
+  _, err = io.Copy(file, r)
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(path)
+    return "", err
+  }
+
+  l.downloads[name] = path
+
+  return path, nil
+}
+
+// Close removes the files downloaded from box
+func (l *backupLocator) Close() error {
+  if l.downloadDir == "" {
+    return nil
+  }
+
+  return os.RemoveAll(l.downloadDir)
+}
+
+func (l *backupLocator) openVolumes(manifestName string) (io.ReadCloser, error) {
+  r, err := l.openFile(manifestName)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+
+  var manifest volumeManifest
+  err = json.NewDecoder(r).Decode(&manifest)
+  if err != nil {
+    return nil, err
+  }
+
+  return &volumeReader{
+    locator: l,
+    from: manifestName,
+    volumes: manifest.Volumes,
+  }, nil
+}
+
+// open returns the contents of a backup, transparently joining the
+// volumes of a split archive
+func (l *backupLocator) open(name string) (io.ReadCloser, error) {
+  if strings.HasSuffix(name, VOLUME_MANIFEST_SUFFIX) {
+    return l.openVolumes(name)
+  }
+
+  // Prefer a local split archive over asking box for the whole file
+  if _, err := os.Stat(name); err != nil {
+    if _, err := os.Stat(name + VOLUME_MANIFEST_SUFFIX); err == nil {
+      return l.openVolumes(name + VOLUME_MANIFEST_SUFFIX)
+    }
+  }
+
+  r, err := l.openFile(name)
+  if err == nil || !errors.Is(err, errBackupNotFound) {
+    return r, err
+  }
+
+  r, err = l.openVolumes(name + VOLUME_MANIFEST_SUFFIX)
+  if errors.Is(err, errBackupNotFound) {
+    return nil, errors.New("No backup found locally or in box named " + name)
+  }
+
+  return r, err
+}
+
+// backupBaseName maps any file belonging to a backup, including the
+// volumes of a split archive and their manifest, to the archive name.
+// Files that are not part of a backup map to an empty string.
+func backupBaseName(name string) string {
+  name = filepath.Base(name)
+  name = strings.TrimSuffix(name, VOLUME_MANIFEST_SUFFIX)
+
+  if ext := filepath.Ext(name); len(ext) == 4 {
+    if _, err := strconv.Atoi(ext[1:]); err == nil {
+      name = strings.TrimSuffix(name, ext)
+    }
+  }
+
+  if !strings.HasSuffix(name, FULL_ARCHIVE_SUFFIX) {
+    return ""
+  }
+
+  return name
+}
+
+// backupArchiveName names a new archive, the unix time in milliseconds
+// prefixed with the job so jobs sharing a folder can tell their backups
+// apart
+func backupArchiveName(job string, created time.Time, suffix string) string {
+  name := strconv.FormatInt(created.UTC().UnixMilli(), 10) + suffix
+  if job == "" {
+    return name
+  }
+
+  return job + BACKUP_JOB_SEPARATOR + name
+}
+
+// splitBackupName splits a backup name into its job, empty for backups
+// made outside a job, and its creation time stamp
+func splitBackupName(backup string) (string, string) {
+  stem := strings.TrimSuffix(backup, FULL_ARCHIVE_SUFFIX)
+  stem = strings.TrimSuffix(stem, strings.TrimSuffix(INCREMENTAL_ARCHIVE_SUFFIX, FULL_ARCHIVE_SUFFIX))
+
+  i := strings.LastIndex(stem, BACKUP_JOB_SEPARATOR)
+  if i < 0 {
+    return "", stem
+  }
+
+  return stem[:i], stem[i+1:]
+}
+
+// jobBackups returns the backups that belong to job. Backups made
+// before archive names carried the job belong to no job, so retention
+// of a job leaves them alone.
+func jobBackups(backups []string, job string) []string {
+  var result []string
+  for _, backup := range backups {
+    if backupJob, _ := splitBackupName(backup); backupJob == job {
+      result = append(result, backup)
+    }
+  }
+
+  return result
+}
+
+// groupBackups collects file names into backups, returning the backup
+// names oldest first along with the files that make up each of them
+func groupBackups(names []string) ([]string, map[string][]string) {
+  members := map[string][]string{}
+  var backups []string
+
+  for _, name := range names {
+    base := backupBaseName(name)
+    if base == "" {
+      continue
+    }
+
+    if _, ok := members[base]; !ok {
+      backups = append(backups, base)
+    }
+    members[base] = append(members[base], name)
+  }
+
+  sort.Sort(ByName(backups))
+  return backups, members
+}
+
+// backupsToRemove returns the oldest backups beyond limit. Incrementals
+// are useless without the full backup that starts their chain, so any
+// left at the start of the kept set are removed along with it. The
+// newest full backup and its chain are always kept, the second result
+// reports when that takes more than limit backups.
+func backupsToRemove(backups []string, limit int64) ([]string, bool) {
+  numberToRemove := int64(len(backups)) - limit
+  if numberToRemove <= 0 {
+    return nil, false
+  }
+
+  for numberToRemove < int64(len(backups)) && isIncrementalArchive(backups[numberToRemove]) {
+    numberToRemove++
+  }
+
+  newestFull := int64(-1)
+  for i := len(backups) - 1; i >= 0; i-- {
+    if !isIncrementalArchive(backups[i]) {
+      newestFull = int64(i)
+      break
+    }
+  }
+
+  if newestFull >= 0 && numberToRemove > newestFull {
+    return backups[:newestFull], true
+  }
+
+  // Incrementals whose full backup is gone are useless, but the newest
+  // may be the one the run just made
+  if numberToRemove == int64(len(backups)) {
+    numberToRemove--
+  }
+
+  return backups[:numberToRemove], false
+}
+
+// localBackupExists reports whether a backup, split or not, is stored
+// in dir
+func localBackupExists(dir string, name string) bool {
+  for _, candidate := range []string{name, name + VOLUME_MANIFEST_SUFFIX} {
+    if _, err := os.Stat(filepath.Join(dir, candidate)); err == nil {
+      return true
+    }
+  }
+
+  return false
+}
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// testBackups names backups oldest first from a pattern of F for full
+// and I for incremental archives
+func testBackups(pattern string) []string {
+  var backups []string
+  for i, kind := range pattern {
+    suffix := FULL_ARCHIVE_SUFFIX
+    if kind == 'I' {
+      suffix = INCREMENTAL_ARCHIVE_SUFFIX
+    }
+    backups = append(backups, "job-" + strconv.Itoa(1000 + i) + suffix)
+  }
+
+  return backups
+}
+
+func TestBackupsToRemove(t *testing.T) {
+  tests := []struct {
+    name string
+    backups string
+    limit int64
+    removed int
+    keptChain bool
+  }{
+    {"under limit", "FFF", 5, 0, false},
+    {"at limit", "FFFFF", 5, 0, false},
+    {"full backups", "FFFFFF", 5, 1, false},
+    {"limit of one", "FFF", 1, 2, false},
+    {"whole old chain", "FIIFII", 4, 3, false},
+    {"chain start", "FIIFII", 5, 3, false},
+    {"old chain and more", "FIIFIIFI", 3, 6, false},
+    {"current chain over limit", "FIIIII", 5, 0, true},
+    {"current chain over limit after old chain", "FIFIIIII", 5, 2, true},
+    {"current chain at limit", "FIFIIII", 5, 2, false},
+    {"only incrementals", "III", 1, 2, false},
+    {"only incrementals over limit", "IIII", 2, 3, false},
+    {"empty", "", 5, 0, false},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      backups := testBackups(test.backups)
+      toRemove, keptChain := backupsToRemove(backups, test.limit)
+
+      want := backups[:test.removed]
+      if len(toRemove) != 0 || len(want) != 0 {
+        if !reflect.DeepEqual(toRemove, want) {
+          t.Errorf("removed %q, want %q", toRemove, want)
+        }
+      }
+      if keptChain != test.keptChain {
+        t.Errorf("kept chain %v, want %v", keptChain, test.keptChain)
+      }
+    })
+  }
+}
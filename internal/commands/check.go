@@ -0,0 +1,332 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/jdollar/backup/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+const MAX_AGE_FLAG = "max-age"
+const MIN_SIZE_RATIO_FLAG = "min-size-ratio"
+
+// Nagios plugin states, which are also the exit codes
+const CHECK_OK = 0
+const CHECK_WARNING = 1
+const CHECK_CRITICAL = 2
+const CHECK_UNKNOWN = 3
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+type checkOptions struct {
+  MaxAge time.Duration
+  MinSizeRatio float64
+}
+
+type checkResult struct {
+  Target string
+  State int
+  Message string
+  Age time.Duration
+  Size int64
+}
+
+type storedBackup struct {
+  Name string
+  Time time.Time
+  Size int64
+}
+
+// backupTime reads the creation time from a backup name, the unix time
+// in milliseconds after the job
+func backupTime(name string) (time.Time, error) {
+  _, stamp := splitBackupName(name)
+  millis, err := strconv.ParseInt(stamp, 10, 64)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  return time.UnixMilli(millis), nil
+}
+
+// storedBackups groups the objects of a backend into the complete
+// backups of job, newest first
+func storedBackups(objects []storage.Object, job string) []storedBackup {
+  sizes := map[string]int64{}
+  var names []string
+  for _, object := range objects {
+    sizes[object.Name] = object.Size
+    names = append(names, object.Name)
+  }
+
+  backups, members := groupBackups(names)
+
+  var result []storedBackup
+  for _, name := range jobBackups(backups, job) {
+    if !completeBackup(name, members[name]) {
+      continue
+    }
+
+    created, err := backupTime(name)
+    if err != nil {
+      continue
+    }
+
+    backup := storedBackup{
+      Name: name,
+      Time: created,
+    }
+    for _, member := range members[name] {
+      backup.Size += sizes[member]
+    }
+    result = append(result, backup)
+  }
+
+  sort.Slice(result, func(i, j int) bool {
+    return result[i].Time.After(result[j].Time)
+  })
+  return result
+}
+
+// lastSuccessTime is when the job last succeeded according to the
+// history, zero when unknown. Runs skipped because nothing changed
+// count, though they leave no new backup behind.
+func lastSuccessTime(job string) time.Time {
+  store, err := historyStore()
+  if err != nil {
+    return time.Time{}
+  }
+
+  run, err := store.LastSuccess(job)
+  if err != nil {
+    return time.Time{}
+  }
+
+  return run.Finished
+}
+
+// checkBackend checks the backups stored in a backend. The age is taken
+// from the last successful run when that is newer than the newest
+// backup, the listing still decides whether backups are missing.
+func checkBackend(ctx context.Context, target string, backend storage.Backend, job string, lastSuccess time.Time, opts checkOptions) checkResult {
+  result := checkResult{
+    Target: target,
+  }
+
+  objects, err := backend.List(ctx)
+  if err != nil {
+    result.State = CHECK_UNKNOWN
+    result.Message = "error listing backups: " + err.Error()
+    return result
+  }
+
+  backups := storedBackups(objects, job)
+  if len(backups) == 0 {
+    result.State = CHECK_CRITICAL
+    result.Message = "no backups found"
+    return result
+  }
+
+  newest := backups[0]
+  result.Age = time.Since(newest.Time)
+  result.Size = newest.Size
+  age := fmt.Sprintf("newest backup %s is %s old", newest.Name, result.Age.Round(time.Minute))
+  if lastSuccess.After(newest.Time) {
+    result.Age = time.Since(lastSuccess)
+    age = fmt.Sprintf("newest backup %s, last successful run %s ago", newest.Name, result.Age.Round(time.Minute))
+  }
+
+  if result.Age > opts.MaxAge {
+    result.State = CHECK_CRITICAL
+    result.Message = age
+    return result
+  }
+
+  // Incrementals are only compared with incrementals, they are always
+  // far smaller than a full backup
+  for _, previous := range backups[1:] {
+    if isIncrementalArchive(previous.Name) != isIncrementalArchive(newest.Name) {
+      continue
+    }
+
+    if opts.MinSizeRatio > 0 && float64(newest.Size) < float64(previous.Size) * opts.MinSizeRatio {
+      result.State = CHECK_WARNING
+      result.Message = fmt.Sprintf(
+        "newest backup %s is %s, previous was %s",
+        newest.Name,
+        files.FormatBytes(newest.Size),
+        files.FormatBytes(previous.Size),
+      )
+      return result
+    }
+    break
+  }
+
+  result.Message = age + ", " + files.FormatBytes(newest.Size)
+  return result
+}
+
+func checkDestination(ctx context.Context, conf config.Configuration, target string, destination string, job string, lastSuccess time.Time, opts checkOptions) checkResult {
+  backend, err := openDestination(ctx, conf, destination)
+  if err != nil {
+    return checkResult{
+      Target: target,
+      State: CHECK_UNKNOWN,
+      Message: err.Error(),
+    }
+  }
+
+  return checkBackend(ctx, target, backend, job, lastSuccess, opts)
+}
+
+func checkLocal(ctx context.Context, target string, outputDirectory string, job string, lastSuccess time.Time, opts checkOptions) checkResult {
+  backend, err := storage.NewLocal(outputDirectory)
+  if err != nil {
+    return checkResult{
+      Target: target,
+      State: CHECK_UNKNOWN,
+      Message: err.Error(),
+    }
+  }
+
+  return checkBackend(ctx, target, backend, job, lastSuccess, opts)
+}
+
+func checkJobs(ctx context.Context, conf config.Configuration, names []string, opts checkOptions) []checkResult {
+  var results []checkResult
+  for _, name := range names {
+    job, ok := conf.Jobs[name]
+    if !ok {
+      results = append(results, checkResult{
+        Target: name,
+        State: CHECK_UNKNOWN,
+        Message: "unknown job",
+      })
+      continue
+    }
+
+    jobOpts, err := backupOptionsFromJob(conf, name, job)
+    if err != nil {
+      results = append(results, checkResult{
+        Target: name,
+        State: CHECK_UNKNOWN,
+        Message: err.Error(),
+      })
+      continue
+    }
+
+    lastSuccess := lastSuccessTime(name)
+    results = append(results, checkLocal(ctx, name + "/local", jobOpts.OutputDirectory, name, lastSuccess, opts))
+    for _, destination := range jobOpts.Destinations {
+      results = append(results, checkDestination(ctx, conf, name + "/" + destination, destination, name, lastSuccess, opts))
+    }
+  }
+
+  return results
+}
+
+// formatCheck renders the results as a single line plugin output with
+// performance data
+func formatCheck(results []checkResult) (int, string) {
+  state := CHECK_OK
+  var problems, details, perfdata []string
+  for _, result := range results {
+    if result.State > state {
+      state = result.State
+    }
+
+    line := result.Target + ": " + result.Message
+    if result.State != CHECK_OK {
+      problems = append(problems, line)
+    } else {
+      details = append(details, line)
+    }
+
+    if result.State != CHECK_UNKNOWN && result.Size > 0 {
+      perfdata = append(perfdata,
+        fmt.Sprintf("'%s age'=%ds", result.Target, int64(result.Age.Seconds())),
+        fmt.Sprintf("'%s size'=%dB", result.Target, result.Size),
+      )
+    }
+  }
+
+  summary := append(problems, details...)
+  output := "BACKUP " + checkStateNames[state] + " - " + strings.Join(summary, "; ")
+  if len(perfdata) > 0 {
+    output += " | " + strings.Join(perfdata, " ")
+  }
+
+  return state, output
+}
+
+func checkCommandAction(conf config.Configuration, c *cli.Context) error {
+  opts := checkOptions{
+    MaxAge: c.Duration(MAX_AGE_FLAG),
+    MinSizeRatio: c.Float64(MIN_SIZE_RATIO_FLAG),
+  }
+
+  var results []checkResult
+  if len(conf.Jobs) == 0 && c.NArg() == 0 {
+    lastSuccess := lastSuccessTime("")
+    outputDirectory := c.String(OUTPUT_DIRECTORY_FLAG)
+    if outputDirectory != "" {
+      results = append(results, checkLocal(c.Context, "local", outputDirectory, "", lastSuccess, opts))
+    }
+    results = append(results, checkDestination(c.Context, conf, BOX_DESTINATION, BOX_DESTINATION, "", lastSuccess, opts))
+  } else {
+    names := c.Args().Slice()
+    if len(names) == 0 {
+      for name := range conf.Jobs {
+        names = append(names, name)
+      }
+      sort.Strings(names)
+    }
+    results = checkJobs(c.Context, conf, names, opts)
+  }
+
+  state, output := formatCheck(results)
+  fmt.Println(output)
+
+  if state != CHECK_OK {
+    return cli.Exit("", state)
+  }
+
+  return nil
+}
+
+func NewCheckCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return checkCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "check",
+    Usage: "Check the newest backup of each destination as a Nagios plugin",
+    ArgsUsage: "[jobs...]",
+    Flags: []cli.Flag{
+      &cli.DurationFlag{
+        Name: MAX_AGE_FLAG,
+        Usage: "Critical when the newest backup is older than this",
+        Value: 26 * time.Hour,
+      },
+      &cli.Float64Flag{
+        Name: MIN_SIZE_RATIO_FLAG,
+        Usage: "Warn when the newest backup is smaller than this fraction of the previous one, 0 to disable",
+        Value: 0.5,
+      },
+      &cli.StringFlag{
+        Name: OUTPUT_DIRECTORY_FLAG,
+        Aliases: []string{"o"},
+        Usage: "Output directory to check as well when no jobs are configured",
+      },
+    },
+    Action: commandAction,
+  }
+}
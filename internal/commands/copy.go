@@ -0,0 +1,178 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/jdollar/backup/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+const FROM_FLAG = "from"
+const TO_FLAG = "to"
+const DRY_RUN_FLAG = "dry-run"
+
+// copyObject streams an object from one backend to another, checking
+// the data against the checksums both sides report. A copy that does
+// not match is removed again. Cancelling ctx stops the copy, backends
+// discard the partial object.
+func copyObject(ctx context.Context, from storage.Backend, to storage.Backend, object storage.Object) (storage.Object, error) {
+  r, err := from.Open(ctx, object.Name)
+  if err != nil {
+    return storage.Object{}, err
+  }
+  defer r.Close()
+
+  h := sha1.New()
+  saved, err := to.Save(ctx, object.Name, io.TeeReader(r, h), object.Size)
+  if err != nil {
+    return saved, err
+  }
+
+  sum := hex.EncodeToString(h.Sum(nil))
+  var mismatch string
+  switch {
+  case object.Sha1 != "" && object.Sha1 != sum:
+    mismatch = fmt.Sprintf("read %s, source reports %s", sum, object.Sha1)
+  case saved.Sha1 != "" && saved.Sha1 != sum:
+    mismatch = fmt.Sprintf("read %s, destination reports %s", sum, saved.Sha1)
+  case saved.Size != object.Size:
+    mismatch = fmt.Sprintf("copied %d bytes, source has %d", saved.Size, object.Size)
+  }
+
+  if mismatch != "" {
+    to.Remove(ctx, object.Name)
+    return storage.Object{}, errors.New("Checksum mismatch copying " + object.Name + ": " + mismatch)
+  }
+
+  return saved, nil
+}
+
+// missingObjects returns the backup files in from that to does not have,
+// grouped by backup oldest first. Volume manifests come last within
+// their backup so an interrupted copy never looks complete.
+func missingObjects(from []storage.Object, to []storage.Object) []storage.Object {
+  existing := map[string]bool{}
+  for _, object := range to {
+    existing[object.Name] = true
+  }
+
+  byName := map[string]storage.Object{}
+  var names []string
+  for _, object := range from {
+    byName[object.Name] = object
+    names = append(names, object.Name)
+  }
+
+  backups, members := groupBackups(names)
+
+  var missing []storage.Object
+  for _, backup := range backups {
+    var manifests []storage.Object
+    for _, name := range members[backup] {
+      if existing[name] {
+        continue
+      }
+
+      if strings.HasSuffix(name, VOLUME_MANIFEST_SUFFIX) {
+        manifests = append(manifests, byName[name])
+      } else {
+        missing = append(missing, byName[name])
+      }
+    }
+    missing = append(missing, manifests...)
+  }
+
+  return missing
+}
+
+func copyCommandAction(conf config.Configuration, c *cli.Context) error {
+  fromName := c.String(FROM_FLAG)
+  toName := c.String(TO_FLAG)
+  if fromName == toName {
+    return withExitCode(EXIT_CONFIG, errors.New("copy needs two different destinations"))
+  }
+
+  from, err := openDestination(c.Context, conf, fromName)
+  if err != nil {
+    return err
+  }
+
+  to, err := openDestination(c.Context, conf, toName)
+  if err != nil {
+    return err
+  }
+
+  fromObjects, err := from.List(c.Context)
+  if err != nil {
+    return err
+  }
+
+  toObjects, err := to.List(c.Context)
+  if err != nil {
+    return err
+  }
+
+  missing := missingObjects(fromObjects, toObjects)
+  if len(missing) == 0 {
+    slog.Info("Destination already has every backup", "from", fromName, "to", toName)
+    return nil
+  }
+
+  var total int64
+  for _, object := range missing {
+    total += object.Size
+  }
+  slog.Info("Copying backups", "from", fromName, "to", toName, "files", len(missing), "size", total)
+
+  for _, object := range missing {
+    if c.Bool(DRY_RUN_FLAG) {
+      fmt.Printf("%s (%s)\n", object.Name, files.FormatBytes(object.Size))
+      continue
+    }
+
+    slog.Info("Copying", "archive", object.Name, "size", object.Size, "from", fromName, "to", toName)
+    _, err = copyObject(c.Context, from, to, object)
+    if err != nil {
+      return withExitCode(EXIT_UPLOAD, err)
+    }
+  }
+
+  return nil
+}
+
+func NewCopyCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return copyCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "copy",
+    Usage: "Copy backups missing from one destination over from another",
+    Flags: []cli.Flag{
+      &cli.StringFlag{
+        Name: FROM_FLAG,
+        Usage: "Destination to copy backups from",
+        Required: true,
+      },
+      &cli.StringFlag{
+        Name: TO_FLAG,
+        Usage: "Destination to copy backups to",
+        Required: true,
+      },
+      &cli.BoolFlag{
+        Name: DRY_RUN_FLAG,
+        Usage: "List the backups that would be copied without copying them",
+      },
+    },
+    Action: commandAction,
+  }
+}
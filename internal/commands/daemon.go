@@ -0,0 +1,349 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+	"github.com/jdollar/backup/internal/schedule"
+	"github.com/urfave/cli/v2"
+)
+
+const METRICS_LISTEN_FLAG = "metrics-listen"
+
+// MAX_DAEMON_SLEEP bounds how long the daemon sleeps at once so a
+// suspended host or a clock change is noticed quickly after waking
+const MAX_DAEMON_SLEEP = time.Minute
+
+// MISSED_RUN_GRACE is how late a run can start before it is logged as
+// a catch-up of a missed run
+const MISSED_RUN_GRACE = 2 * time.Minute
+
+type daemonState struct {
+  LastRuns map[string]time.Time `json:"last_runs"`
+}
+
+type scheduledJob struct {
+  name string
+  opts backupOptions
+  schedule schedule.Schedule
+  jitter time.Duration
+  next time.Time
+  running bool
+}
+
+type daemon struct {
+  conf config.Configuration
+  statePath string
+  jobs []*scheduledJob
+
+  mu sync.Mutex
+  state daemonState
+
+  // wg tracks running jobs and queue drains so shutting down can wait
+  // for them to clean up
+  wg sync.WaitGroup
+}
+
+func loadDaemonState(path string) (daemonState, error) {
+  state := daemonState{
+    LastRuns: map[string]time.Time{},
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return state, nil
+    }
+    return state, err
+  }
+
+  err = json.Unmarshal(data, &state)
+  if state.LastRuns == nil {
+    state.LastRuns = map[string]time.Time{}
+  }
+
+  return state, err
+}
+
+// saveState must be called with mu held
+func (d *daemon) saveState() error {
+  data, err := json.Marshal(d.state)
+  if err != nil {
+    return err
+  }
+
+  tmpPath := d.statePath + ".tmp"
+  err = ioutil.WriteFile(tmpPath, data, 0644)
+  if err != nil {
+    return err
+  }
+
+  return os.Rename(tmpPath, d.statePath)
+}
+
+func newDaemon(conf config.Configuration) (*daemon, error) {
+  configDir, err := config.Directory()
+  if err != nil {
+    return nil, err
+  }
+
+  d := &daemon{
+    conf: conf,
+    statePath: filepath.Join(configDir, "daemon-state.json"),
+  }
+
+  d.state, err = loadDaemonState(d.statePath)
+  if err != nil {
+    return nil, err
+  }
+
+  for name, job := range conf.Jobs {
+    if job.Schedule == "" {
+      continue
+    }
+
+    opts, err := backupOptionsFromJob(conf, name, job)
+    if err != nil {
+      return nil, err
+    }
+
+    sched, err := schedule.Parse(job.Schedule)
+    if err != nil {
+      return nil, errors.New("Invalid schedule for job " + name + ": " + err.Error())
+    }
+
+    var jitter time.Duration
+    if job.Jitter != "" {
+      jitter, err = time.ParseDuration(job.Jitter)
+      if err != nil {
+        return nil, err
+      }
+    }
+
+    d.jobs = append(d.jobs, &scheduledJob{
+      name: name,
+      opts: opts,
+      schedule: sched,
+      jitter: jitter,
+    })
+  }
+
+  if len(d.jobs) == 0 {
+    return nil, errors.New("No jobs with a schedule found in the configuration")
+  }
+
+  return d, nil
+}
+
+// initialRun picks the first run of a job. A run that should have
+// happened while the daemon was down is due straight away.
+func (d *daemon) initialRun(job *scheduledJob, now time.Time) time.Time {
+  lastRun, ok := d.state.LastRuns[job.name]
+  if !ok {
+    return job.schedule.Next(now)
+  }
+
+  return job.schedule.Next(lastRun)
+}
+
+func (d *daemon) runJob(ctx context.Context, job *scheduledJob) {
+  defer d.wg.Done()
+
+  if job.jitter > 0 {
+    delay := time.Duration(rand.Int63n(int64(job.jitter)))
+    job.opts.logger().Info("Delaying job by jitter", "delay", delay.Round(time.Second).String())
+
+    select {
+    case <-ctx.Done():
+      d.mu.Lock()
+      job.running = false
+      d.mu.Unlock()
+      return
+    case <-time.After(delay):
+    }
+  }
+
+  started := time.Now()
+  job.opts.logger().Info("Starting job")
+  err := runBackup(ctx, d.conf, job.opts)
+  if err != nil {
+    job.opts.logger().Error("Job failed", logging.Err(err))
+  } else {
+    job.opts.logger().Info("Job finished", "duration", time.Since(started).Round(time.Second).String())
+  }
+
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  job.running = false
+  d.state.LastRuns[job.name] = started
+  err = d.saveState()
+  if err != nil {
+    slog.Error("Error saving daemon state", logging.Err(err))
+  }
+}
+
+func logNextRun(job *scheduledJob) {
+  if job.next.IsZero() {
+    job.opts.logger().Warn("Job has no upcoming runs")
+    return
+  }
+
+  job.opts.logger().Info("Scheduled next run", "next_run", job.next)
+}
+
+// tick starts every job that is due and returns when the next one is
+func (d *daemon) tick(ctx context.Context, now time.Time) time.Time {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  var soonest time.Time
+  for _, job := range d.jobs {
+    if !job.next.IsZero() && !now.Before(job.next) {
+      if job.running {
+        job.opts.logger().Warn("Job is still running, skipping scheduled run", "scheduled", job.next)
+      } else {
+        if now.Sub(job.next) > MISSED_RUN_GRACE {
+          job.opts.logger().Info("Catching up on missed run", "scheduled", job.next)
+        }
+
+        job.running = true
+        d.wg.Add(1)
+        go d.runJob(ctx, job)
+      }
+
+      // Scheduling from now rather than the missed time collapses any
+      // number of missed runs into the single catch-up run
+      job.next = job.schedule.Next(now)
+      logNextRun(job)
+    }
+
+    if !job.next.IsZero() && (soonest.IsZero() || job.next.Before(soonest)) {
+      soonest = job.next
+    }
+  }
+
+  return soonest
+}
+
+// run starts jobs as they become due until ctx is cancelled, then waits
+// for the running jobs to stop
+func (d *daemon) run(ctx context.Context) error {
+  now := time.Now()
+  for _, job := range d.jobs {
+    job.next = d.initialRun(job, now)
+    logNextRun(job)
+  }
+
+  drainRunning := false
+  drained := make(chan bool, 1)
+  for {
+    soonest := d.tick(ctx, time.Now())
+
+    select {
+    case <-drained:
+      drainRunning = false
+    default:
+    }
+
+    // Queued uploads are retried between jobs as their backoff expires
+    if !drainRunning {
+      drainRunning = true
+      d.wg.Add(1)
+      go func() {
+        defer d.wg.Done()
+        err := drainUploadQueue(ctx, d.conf)
+        if err != nil {
+          slog.Error("Error retrying queued uploads", logging.Err(err))
+        }
+        drained <- true
+      }()
+    }
+
+    sleep := MAX_DAEMON_SLEEP
+    if !soonest.IsZero() {
+      if untilNext := time.Until(soonest); untilNext < sleep {
+        sleep = untilNext
+      }
+    }
+
+    if sleep < 0 {
+      sleep = 0
+    }
+
+    select {
+    case <-ctx.Done():
+      slog.Info("Stopping daemon, waiting for running jobs")
+      d.wg.Wait()
+      return ctx.Err()
+    case <-time.After(sleep):
+    }
+  }
+}
+
+// serveMetrics exposes the metrics for Prometheus to scrape
+func serveMetrics(address string) {
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", metrics.Default)
+
+  slog.Info("Serving metrics", "address", address)
+  err := http.ListenAndServe(address, mux)
+  slog.Error("Metrics server stopped", logging.Err(err))
+}
+
+func daemonCommandAction(conf config.Configuration, c *cli.Context) error {
+  d, err := newDaemon(conf)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  var jobs []string
+  for _, job := range d.jobs {
+    jobs = append(jobs, job.name)
+  }
+  err = seedLastSuccessMetrics(jobs)
+  if err != nil {
+    slog.Warn("Error reading last successful runs from the history", logging.Err(err))
+  }
+
+  address := c.String(METRICS_LISTEN_FLAG)
+  if address == "" {
+    address = conf.Metrics.Listen
+  }
+  if address != "" {
+    go serveMetrics(address)
+  }
+
+  slog.Info("Starting daemon", "jobs", len(d.jobs))
+  return d.run(c.Context)
+}
+
+func NewDaemonCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return daemonCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "daemon",
+    Usage: "Run scheduled backup jobs from the configuration file",
+    Flags: []cli.Flag{
+      &cli.StringFlag{
+        Name: METRICS_LISTEN_FLAG,
+        Usage: "Address to serve Prometheus metrics on, e.g. :9101",
+      },
+    },
+    Action: commandAction,
+  }
+}
@@ -0,0 +1,335 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdollar/backup/internal/box"
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+	"github.com/jdollar/backup/internal/progress"
+	"github.com/jdollar/backup/internal/s3"
+	"github.com/jdollar/backup/internal/storage"
+)
+
+// BOX_DESTINATION is the destination used when none is configured. It
+// uploads to the folder from the top level box settings unless the
+// destinations map overrides it.
+const BOX_DESTINATION = "box"
+
+func openDestination(ctx context.Context, conf config.Configuration, name string) (storage.Backend, error) {
+  destConf, ok := conf.Destinations[name]
+  if !ok {
+    if name != BOX_DESTINATION {
+      return nil, errors.New("Unknown destination " + name)
+    }
+
+    destConf = config.DestinationConfiguration{
+      Type: "box",
+    }
+  }
+
+  switch destConf.Type {
+  case "box":
+    client, err := newBoxClient(ctx, conf)
+    if err != nil {
+      return nil, err
+    }
+
+    folderName := destConf.Folder
+    if folderName == "" {
+      folderName = conf.Box.BackupFolderName
+    }
+
+    folder, err := findOrCreateFolder(ctx, &client, folderName)
+    if box.IsAuth(err) {
+      return nil, fmt.Errorf("Box rejected the credentials, check the client id and secret: %w", err)
+    }
+    if err != nil {
+      return nil, err
+    }
+
+    client.SetProgress(func(update progress.Update) {
+      update.Name = name + ": " + update.Name
+      progress.Default().Update(update)
+    })
+
+    return storage.NewBox(&client, folder), nil
+  case "local":
+    if destConf.Path == "" {
+      return nil, errors.New("Missing path for destination " + name)
+    }
+
+    return storage.NewLocal(destConf.Path)
+  case "s3":
+    client, err := newS3Client(destConf)
+    if err != nil {
+      return nil, errors.New("Invalid destination " + name + ": " + err.Error())
+    }
+
+    client.SetProgress(func(update progress.Update) {
+      update.Name = name + ": " + update.Name
+      progress.Default().Update(update)
+    })
+
+    return storage.NewS3(&client, destConf.Prefix), nil
+  }
+
+  return nil, errors.New("Invalid type " + destConf.Type + " for destination " + name + ", expected box, local or s3")
+}
+
+// newS3Client connects to the bucket of an s3 destination, with the
+// keys from the environment when the destination has none
+func newS3Client(destConf config.DestinationConfiguration) (s3.Client, error) {
+  copts := s3.ClientOpts{
+    Endpoint: destConf.Endpoint,
+    Region: destConf.Region,
+    Bucket: destConf.Bucket,
+    AccessKeyId: destConf.AccessKeyId,
+    SecretAccessKey: destConf.SecretAccessKey,
+  }
+
+  if copts.AccessKeyId == "" && copts.SecretAccessKey == "" {
+    copts.AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+    copts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+    copts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+  }
+  if copts.Region == "" {
+    copts.Region = os.Getenv("AWS_REGION")
+  }
+
+  if copts.AccessKeyId == "" || copts.SecretAccessKey == "" {
+    return s3.Client{}, errors.New("Missing access_key_id or secret_access_key")
+  }
+
+  return s3.NewClient(copts)
+}
+
+// localBackups lists the backups of job in the output directory that
+// should be on a destination with the given retention. Backups retention would
+// remove straight away and split archives still missing their volume
+// manifest are left out.
+func localBackups(ctx context.Context, local storage.Backend, job string, limit int64) ([]storage.Object, error) {
+  objects, err := local.List(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  var names []string
+  for _, object := range objects {
+    names = append(names, object.Name)
+  }
+
+  backups, members := groupBackups(names)
+  backups = jobBackups(backups, job)
+  removed := map[string]bool{}
+  toRemove, _ := backupsToRemove(backups, limit)
+  for _, backup := range toRemove {
+    removed[backup] = true
+  }
+
+  wanted := map[string]bool{}
+  for _, backup := range backups {
+    if removed[backup] || !completeBackup(backup, members[backup]) {
+      continue
+    }
+
+    for _, name := range members[backup] {
+      wanted[name] = true
+    }
+  }
+
+  var result []storage.Object
+  for _, object := range objects {
+    if wanted[object.Name] {
+      result = append(result, object)
+    }
+  }
+
+  return result, nil
+}
+
+// completeBackup reports whether every file of a backup is present,
+// which for split archives means the manifest has been written
+func completeBackup(backup string, members []string) bool {
+  for _, name := range members {
+    if name == backup || name == backup + VOLUME_MANIFEST_SUFFIX {
+      return true
+    }
+  }
+
+  return false
+}
+
+// remoteOnlyBackups returns backups of job a destination has that the
+// output directory does not
+func remoteOnlyBackups(job string, local []storage.Object, remote []storage.Object) []string {
+  var localNames, remoteNames []string
+  for _, object := range local {
+    localNames = append(localNames, object.Name)
+  }
+  for _, object := range remote {
+    remoteNames = append(remoteNames, object.Name)
+  }
+
+  _, localMembers := groupBackups(localNames)
+  remoteBackups, _ := groupBackups(remoteNames)
+
+  var remoteOnly []string
+  for _, backup := range jobBackups(remoteBackups, job) {
+    if _, ok := localMembers[backup]; !ok {
+      remoteOnly = append(remoteOnly, backup)
+    }
+  }
+
+  return remoteOnly
+}
+
+// exportToDestination syncs the output directory with a destination,
+// uploading every local backup the destination is missing oldest first
+// so uploads that failed on earlier runs are retried, then applies
+// retention
+func exportToDestination(ctx context.Context, job string, conf config.Configuration, name string, outputDirectory string, limit int64) (objects []storage.Object, err error) {
+  logger := jobLogger(job).With("destination", name)
+  defer func() {
+    if err != nil {
+      metrics.Default.Add(UPLOAD_FAILURES_METRIC, 1, "job", job, "destination", name)
+    }
+  }()
+
+  backend, err := openDestination(ctx, conf, name)
+  if err != nil {
+    return nil, err
+  }
+
+  local, err := storage.NewLocal(outputDirectory)
+  if err != nil {
+    return nil, err
+  }
+
+  localObjects, err := localBackups(ctx, local, job, limit)
+  if err != nil {
+    return nil, err
+  }
+
+  remoteObjects, err := backend.List(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, backup := range remoteOnlyBackups(job, localObjects, remoteObjects) {
+    logger.Info("Backup is only stored in the destination", "archive", backup)
+  }
+
+  logger.Info("Uploading backup files")
+  started := time.Now()
+  for _, object := range missingObjects(localObjects, remoteObjects) {
+    logger.Info("Uploading", "archive", object.Name, "size", object.Size)
+    saved, err := copyObject(ctx, local, backend, object)
+    if err != nil {
+      return objects, err
+    }
+
+    objects = append(objects, saved)
+    metrics.Default.Add(UPLOADED_BYTES_METRIC, float64(saved.Size), "job", job, "destination", name)
+  }
+  logger.Info("Finished uploading", "files", len(objects))
+  recordPhase(job, UPLOAD_PHASE, name, time.Since(started))
+
+  logger.Debug("Cleaning up old backups", "limit", limit)
+  started = time.Now()
+  err = cleanupBackend(ctx, logger, backend, job, limit)
+  if err != nil {
+    return objects, err
+  }
+  recordPhase(job, PRUNE_PHASE, name, time.Since(started))
+  logger.Debug("Finished cleaning old backups")
+
+  return objects, nil
+}
+
+// destinationResult is the outcome of exporting to one destination
+type destinationResult struct {
+  Name string
+  Objects []storage.Object
+  Err error
+}
+
+// destinationLimit is the retention for a destination, which can
+// override the job's backup limit
+func destinationLimit(conf config.Configuration, name string, jobLimit int64) int64 {
+  if destConf, ok := conf.Destinations[name]; ok && destConf.BackupLimit > 0 {
+    return destConf.BackupLimit
+  }
+
+  return jobLimit
+}
+
+// exportToDestinations uploads the archive to every destination of the
+// job at once. A failing destination does not stop the others, the
+// results are returned in the order the destinations are listed.
+func exportToDestinations(ctx context.Context, conf config.Configuration, opts backupOptions) []destinationResult {
+  results := make([]destinationResult, len(opts.Destinations))
+
+  var wg sync.WaitGroup
+  for i, name := range opts.Destinations {
+    wg.Add(1)
+    go func(i int, name string) {
+      defer wg.Done()
+
+      limit := destinationLimit(conf, name, opts.BackupLimit)
+      objects, err := exportToDestination(ctx, opts.Job, conf, name, opts.OutputDirectory, limit)
+      results[i] = destinationResult{
+        Name: name,
+        Objects: objects,
+        Err: err,
+      }
+    }(i, name)
+  }
+  wg.Wait()
+
+  return results
+}
+
+// destinationsError logs how each destination did and combines the
+// failures into one error
+func destinationsError(logger *slog.Logger, results []destinationResult) error {
+  for _, result := range results {
+    if result.Err != nil {
+      logger.Error("Destination failed", "destination", result.Name, logging.Err(result.Err))
+    } else {
+      logger.Info("Destination succeeded", "destination", result.Name, "files", len(result.Objects))
+    }
+  }
+
+  return exportError(results)
+}
+
+// exportError combines the failed destinations into one error, exiting
+// with EXIT_PARTIAL when other destinations succeeded
+func exportError(results []destinationResult) error {
+  var failed []string
+  for _, result := range results {
+    if result.Err != nil {
+      failed = append(failed, result.Name + ": " + result.Err.Error())
+    }
+  }
+
+  if len(failed) == 0 {
+    return nil
+  }
+
+  code := EXIT_UPLOAD
+  if len(failed) < len(results) {
+    code = EXIT_PARTIAL
+  }
+
+  return withExitCode(code, errors.New("Failed to export to " + strings.Join(failed, "; ")))
+}
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/urfave/cli/v2"
+)
+
+type ByChangeName []manifestChange
+
+func (a ByChangeName) Len() int           { return len(a) }
+func (a ByChangeName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByChangeName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+func formatDelta(n int64) string {
+  if n >= 0 {
+    return "+" + files.FormatBytes(n)
+  }
+
+  return files.FormatBytes(n)
+}
+
+func readArchiveManifest(locator *backupLocator, name string, m manifest) error {
+  r, err := locator.open(name)
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+
+  slog.Info("Reading manifest", "archive", name)
+  err = readManifest(r, m)
+  if err != nil {
+    return err
+  }
+
+  _, err = io.Copy(ioutil.Discard, r)
+  return err
+}
+
+// readBackupManifest returns the files a restore of name would produce,
+// replaying the chain of an incremental backup
+func readBackupManifest(locator *backupLocator, name string) (manifest, error) {
+  chain, err := resolveChain(locator, name)
+  if err != nil {
+    return nil, err
+  }
+
+  m := manifest{}
+  for _, archive := range chain {
+    err = readArchiveManifest(locator, archive, m)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  return m, nil
+}
+
+func diffCommandAction(conf config.Configuration, c *cli.Context) error {
+  if c.NArg() != 2 {
+    return errors.New("diff requires exactly two backups to compare")
+  }
+
+  locator := newBackupLocator(c.Context, conf)
+  defer locator.Close()
+
+  a, err := readBackupManifest(locator, c.Args().Get(0))
+  if err != nil {
+    return err
+  }
+
+  b, err := readBackupManifest(locator, c.Args().Get(1))
+  if err != nil {
+    return err
+  }
+
+  changes := compareManifests(a, b)
+  sort.Sort(ByChangeName(changes))
+
+  var added, removed, modified int
+  for _, change := range changes {
+    switch change.Kind {
+    case "added":
+      added++
+      fmt.Printf("A %s (%s)\n", change.Name, formatDelta(change.NewSize))
+    case "removed":
+      removed++
+      fmt.Printf("D %s (%s)\n", change.Name, formatDelta(-change.OldSize))
+    case "modified":
+      modified++
+      fmt.Printf(
+        "M %s (%s -> %s, %s)\n",
+        change.Name,
+        files.FormatBytes(change.OldSize),
+        files.FormatBytes(change.NewSize),
+        formatDelta(change.NewSize - change.OldSize),
+      )
+    }
+  }
+
+  fmt.Printf("%d added, %d removed, %d modified\n", added, removed, modified)
+
+  return nil
+}
+
+func NewDiffCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return diffCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "diff",
+    Usage: "Compare the contents of two backups stored locally or in box",
+    ArgsUsage: "<a> <b>",
+    Action: commandAction,
+  }
+}
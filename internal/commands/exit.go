@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Exit codes, so scripts can tell why a command failed. The check
+// command uses the monitoring plugin codes instead.
+const EXIT_FAILURE = 1
+const EXIT_CONFIG = 2
+const EXIT_SOURCE = 3
+const EXIT_ARCHIVE = 4
+const EXIT_UPLOAD = 5
+const EXIT_PARTIAL = 6
+const EXIT_LOCKED = 7
+
+// EXIT_INTERRUPTED is used after SIGINT or SIGTERM stopped the command,
+// as a shell reports a process killed by SIGINT
+const EXIT_INTERRUPTED = 130
+
+// exitError attaches an exit code to an error, urfave/cli reads it
+// through the cli.ExitCoder interface
+type exitError struct {
+  code int
+  err error
+}
+
+func (e *exitError) Error() string {
+  return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+  return e.err
+}
+
+func (e *exitError) ExitCode() int {
+  return e.code
+}
+
+// withExitCode returns err with the given exit code, or nil for a nil
+// err. A code already attached to err is kept.
+func withExitCode(code int, err error) error {
+  if err == nil {
+    return nil
+  }
+
+  var coder cli.ExitCoder
+  if errors.As(err, &coder) {
+    return err
+  }
+
+  return &exitError{
+    code: code,
+    err: err,
+  }
+}
+
+// ExitCode returns the code the process should exit with after err
+func ExitCode(err error) int {
+  if err == nil {
+    return 0
+  }
+
+  var coder cli.ExitCoder
+  if errors.As(err, &coder) {
+    return coder.ExitCode()
+  }
+
+  return EXIT_FAILURE
+}
+
+// combinedExitCode is the code shared by every failure, or the generic
+// failure code when they failed for different reasons
+func combinedExitCode(codes []int) int {
+  if len(codes) == 0 {
+    return EXIT_FAILURE
+  }
+
+  for _, code := range codes[1:] {
+    if code != codes[0] {
+      return EXIT_FAILURE
+    }
+  }
+
+  return codes[0]
+}
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// fingerprintState remembers the inputs of the last uploaded backup.
+// Files keeps the per file hashes so unchanged files are not re-read
+// on every run just to find out nothing happened.
+type fingerprintState struct {
+  Fingerprint string `json:"fingerprint"`
+  Archive string `json:"archive"`
+  Files map[string]snapshotEntry `json:"files"`
+}
+
+func loadFingerprintState(path string) (*fingerprintState, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil, nil
+    }
+    return nil, err
+  }
+
+  var state fingerprintState
+  err = json.Unmarshal(data, &state)
+  if err != nil {
+    return nil, err
+  }
+
+  return &state, nil
+}
+
+func saveFingerprintState(path string, state *fingerprintState) error {
+  data, err := json.Marshal(state)
+  if err != nil {
+    return err
+  }
+
+  tmpPath := path + ".tmp"
+  err = ioutil.WriteFile(tmpPath, data, 0644)
+  if err != nil {
+    return err
+  }
+
+  return os.Rename(tmpPath, path)
+}
+
+// fingerprintSources hashes the names and contents of the files that
+// would go into the archive
+func fingerprintSources(previous *fingerprintState, sources []archiveFile) (*fingerprintState, error) {
+  state := &fingerprintState{
+    Files: map[string]snapshotEntry{},
+  }
+
+  var names []string
+  for _, source := range sources {
+    entry := snapshotEntry{
+      Size: source.Info.Size(),
+      ModTime: source.Info.ModTime().UnixNano(),
+      Inode: fileInode(source.Info),
+    }
+
+    prev, ok := snapshotEntry{}, false
+    if previous != nil {
+      prev, ok = previous.Files[source.Name]
+    }
+
+    if ok && prev.Size == entry.Size && prev.ModTime == entry.ModTime && prev.Inode == entry.Inode {
+      entry.Hash = prev.Hash
+    } else {
+      hash, err := hashFile(source.Name)
+      if err != nil {
+        return nil, err
+      }
+      entry.Hash = hash
+    }
+
+    state.Files[source.Name] = entry
+    names = append(names, source.Name)
+  }
+
+  sort.Sort(ByName(names))
+
+  h := sha256.New()
+  for _, name := range names {
+    entry := state.Files[name]
+    h.Write([]byte(name + "\x00" + strconv.FormatInt(entry.Size, 10) + "\x00" + entry.Hash + "\n"))
+  }
+  state.Fingerprint = hex.EncodeToString(h.Sum(nil))
+
+  return state, nil
+}
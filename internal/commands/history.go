@@ -0,0 +1,204 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/jdollar/backup/internal/history"
+	"github.com/jdollar/backup/internal/hooks"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+	"github.com/urfave/cli/v2"
+)
+
+const LIMIT_FLAG = "limit"
+
+func historyStore() (*history.Store, error) {
+  configDir, err := config.Directory()
+  if err != nil {
+    return nil, err
+  }
+
+  return history.Open(filepath.Join(configDir, "history.db")), nil
+}
+
+// archiveHash hashes the archive, or the volume manifest of a split
+// archive which holds the checksums of the volumes
+func archiveHash(archivePath string) (string, error) {
+  for _, path := range []string{archivePath, archivePath + VOLUME_MANIFEST_SUFFIX} {
+    if _, err := os.Stat(path); err == nil {
+      return hashFile(path)
+    }
+  }
+
+  return "", errors.New("Archive " + archivePath + " not found")
+}
+
+func runOutcome(env hooks.Env, err error) string {
+  if errors.Is(err, context.Canceled) {
+    return "interrupted"
+  }
+  if err != nil {
+    return "failure"
+  }
+
+  switch env.Status {
+  case "queued", "skipped":
+    return env.Status
+  }
+
+  return "success"
+}
+
+// recordHistory saves a finished run. Failing to save it is logged and
+// never fails the backup.
+func recordHistory(opts backupOptions, env hooks.Env, results []destinationResult, started time.Time, runErr error) {
+  run := history.Run{
+    Job: opts.Job,
+    Started: started,
+    Finished: time.Now(),
+    Sources: opts.Sources,
+    ArchiveSize: env.ArchiveSize,
+    Outcome: runOutcome(env, runErr),
+  }
+  if runErr != nil {
+    run.Error = runErr.Error()
+  }
+
+  run.Archive = env.ArchiveName
+  if env.ArchivePath != "" {
+    var err error
+    run.Sha1, err = archiveHash(env.ArchivePath)
+    if err != nil {
+      opts.logger().Warn("Error hashing archive for the history", logging.Err(err))
+    }
+  }
+
+  for _, result := range results {
+    destination := history.Destination{
+      Name: result.Name,
+    }
+    for _, object := range result.Objects {
+      destination.FileIds = append(destination.FileIds, object.Id)
+    }
+    if result.Err != nil {
+      destination.Error = result.Err.Error()
+    }
+    run.Destinations = append(run.Destinations, destination)
+  }
+
+  store, err := historyStore()
+  if err == nil {
+    _, err = store.Add(run)
+  }
+  if err != nil {
+    opts.logger().Error("Error recording run history", logging.Err(err))
+  }
+}
+
+// seedLastSuccessMetrics sets the last success metrics from the history
+// so they are right before the first run after a restart
+func seedLastSuccessMetrics(jobs []string) error {
+  store, err := historyStore()
+  if err != nil {
+    return err
+  }
+
+  for _, job := range jobs {
+    run, err := store.LastSuccess(job)
+    if errors.Is(err, history.ErrNoSuccess) {
+      continue
+    }
+    if err != nil {
+      return err
+    }
+
+    metrics.Default.Set(LAST_SUCCESS_METRIC, float64(run.Finished.Unix()), "job", job)
+  }
+
+  return nil
+}
+
+func formatAge(t time.Time) string {
+  return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func historyCommandAction(conf config.Configuration, c *cli.Context) error {
+  store, err := historyStore()
+  if err != nil {
+    return err
+  }
+
+  jobs := c.Args().Slice()
+  if len(jobs) == 0 {
+    jobs, err = store.Jobs()
+    if err != nil {
+      return err
+    }
+  }
+
+  for _, job := range jobs {
+    runs, err := store.Runs(job, c.Int(LIMIT_FLAG))
+    if err != nil {
+      return err
+    }
+
+    fmt.Println(job + ":")
+    for _, run := range runs {
+      archive := run.Archive
+      if archive == "" {
+        archive = "-"
+      }
+
+      fmt.Printf(
+        "  %s  %-8s  %8s  %s  %s\n",
+        run.Started.Local().Format(time.RFC3339),
+        run.Outcome,
+        run.Finished.Sub(run.Started).Round(time.Second),
+        archive,
+        files.FormatBytes(run.ArchiveSize),
+      )
+
+      for _, destination := range run.Destinations {
+        if destination.Error != "" {
+          fmt.Printf("    %s: failed: %s\n", destination.Name, destination.Error)
+        } else {
+          fmt.Printf("    %s: %s\n", destination.Name, strings.Join(destination.FileIds, " "))
+        }
+      }
+
+      if run.Error != "" {
+        fmt.Printf("    error: %s\n", run.Error)
+      }
+    }
+  }
+
+  return nil
+}
+
+func NewHistoryCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return historyCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "history",
+    Usage: "Show the most recent runs of jobs, all of them by default",
+    ArgsUsage: "[jobs...]",
+    Flags: []cli.Flag{
+      &cli.IntFlag{
+        Name: LIMIT_FLAG,
+        Usage: "Number of runs to show per job",
+        Value: 10,
+      },
+    },
+    Action: commandAction,
+  }
+}
@@ -0,0 +1,41 @@
+package commands
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/hooks"
+)
+
+func newHookRunner(hooksConf config.HooksConfiguration) (hooks.Runner, error) {
+  opts := hooks.Opts{
+    Timeout: hooks.DEFAULT_TIMEOUT,
+    AbortOnPreHookFailure: true,
+    Commands: map[string][]string{
+      hooks.PRE_ARCHIVE: hooksConf.PreArchive,
+      hooks.POST_ARCHIVE: hooksConf.PostArchive,
+      hooks.PRE_UPLOAD: hooksConf.PreUpload,
+      hooks.POST_UPLOAD: hooksConf.PostUpload,
+      hooks.ON_FAILURE: hooksConf.OnFailure,
+    },
+  }
+
+  if hooksConf.Timeout != "" {
+    timeout, err := time.ParseDuration(hooksConf.Timeout)
+    if err != nil {
+      return hooks.Runner{}, err
+    }
+    opts.Timeout = timeout
+  }
+
+  switch hooksConf.PreHookFailure {
+  case "", "abort":
+  case "continue":
+    opts.AbortOnPreHookFailure = false
+  default:
+    return hooks.Runner{}, errors.New("Invalid hooks pre_hook_failure " + hooksConf.PreHookFailure + ", expected abort or continue")
+  }
+
+  return hooks.NewRunner(opts), nil
+}
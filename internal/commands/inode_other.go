@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package commands
+
+import (
+	"os"
+)
+
+// fileInode is not available on this platform so incremental runs fall
+// back to comparing size and modification time
+func fileInode(info os.FileInfo) uint64 {
+  return 0
+}
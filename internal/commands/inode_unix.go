@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package commands
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(info os.FileInfo) uint64 {
+  stat, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0
+  }
+
+  return uint64(stat.Ino)
+}
@@ -0,0 +1,186 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/history"
+	"github.com/jdollar/backup/internal/lock"
+	"github.com/jdollar/backup/internal/logging"
+)
+
+const LOCK_WAIT = "wait"
+const LOCK_SKIP = "skip"
+const LOCK_FAIL = "fail"
+
+// LOCK_POLL_INTERVAL is how often a waiting run checks the lock again
+const LOCK_POLL_INTERVAL = 10 * time.Second
+
+// LOCK_RELEASE_TIMEOUT bounds releasing the remote locks, which still
+// happens after the run was cancelled
+const LOCK_RELEASE_TIMEOUT = time.Minute
+
+// DEFAULT_LOCK_STALE is how old a remote lock, or a local one where
+// files cannot be locked, gets before another run takes it over
+const DEFAULT_LOCK_STALE = 24 * time.Hour
+
+// errLockSkipped is returned instead of waiting with the skip policy
+var errLockSkipped = errors.New("Skipped, another run holds the lock")
+
+type lockOptions struct {
+  Policy string
+  Timeout time.Duration
+  Stale time.Duration
+  Remote bool
+}
+
+func lockOptionsFromConfig(lockConf config.LockConfiguration) (lockOptions, error) {
+  opts := lockOptions{
+    Policy: lockConf.Policy,
+    Stale: DEFAULT_LOCK_STALE,
+    Remote: lockConf.Remote,
+  }
+
+  switch opts.Policy {
+  case "":
+    opts.Policy = LOCK_FAIL
+  case LOCK_WAIT, LOCK_SKIP, LOCK_FAIL:
+  default:
+    return opts, errors.New("Invalid lock policy " + opts.Policy + ", expected wait, skip or fail")
+  }
+
+  var err error
+  if lockConf.Timeout != "" {
+    opts.Timeout, err = time.ParseDuration(lockConf.Timeout)
+    if err != nil {
+      return opts, err
+    }
+  }
+
+  if lockConf.Stale != "" {
+    opts.Stale, err = time.ParseDuration(lockConf.Stale)
+    if err != nil {
+      return opts, err
+    }
+  }
+
+  return opts, nil
+}
+
+// lockName is the name of a job's lock, runs that are not a job share
+// one
+func lockName(job string) string {
+  if job == "" {
+    job = history.DEFAULT_JOB
+  }
+
+  return job + ".lock"
+}
+
+// jobLock is a job's lock file along with its locks in the destinations
+type jobLock struct {
+  file *lock.File
+  remotes []*lock.Remote
+}
+
+func (l *jobLock) release(ctx context.Context, logger *slog.Logger) {
+  ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), LOCK_RELEASE_TIMEOUT)
+  defer cancel()
+
+  for _, remote := range l.remotes {
+    err := remote.Release(ctx)
+    if err != nil {
+      logger.Warn("Error releasing remote lock", logging.Err(err))
+    }
+  }
+
+  if l.file != nil {
+    err := l.file.Release()
+    if err != nil {
+      logger.Warn("Error releasing lock", logging.Err(err))
+    }
+  }
+}
+
+// tryJobLock takes the job's locks once. A destination that cannot be
+// reached is left unlocked, its upload fails and is queued anyway.
+func tryJobLock(ctx context.Context, conf config.Configuration, opts backupOptions) (*jobLock, error) {
+  configDir, err := config.Directory()
+  if err != nil {
+    return nil, err
+  }
+
+  name := lockName(opts.Job)
+  held := &jobLock{}
+  held.file, err = lock.AcquireFile(filepath.Join(configDir, "locks", name), opts.Lock.Stale)
+  if err != nil {
+    return nil, err
+  }
+
+  if !opts.Lock.Remote {
+    return held, nil
+  }
+
+  for _, destination := range opts.Destinations {
+    backend, err := openDestination(ctx, conf, destination)
+    if err != nil {
+      opts.logger().Warn("Not locking destination", "destination", destination, logging.Err(err))
+      continue
+    }
+
+    remote, err := lock.AcquireRemote(ctx, backend, name, opts.Lock.Stale)
+    if errors.Is(err, lock.ErrLocked) {
+      held.release(ctx, opts.logger())
+      return nil, err
+    }
+    if err != nil {
+      opts.logger().Warn("Not locking destination", "destination", destination, logging.Err(err))
+      continue
+    }
+    held.remotes = append(held.remotes, remote)
+  }
+
+  return held, nil
+}
+
+// acquireJobLock takes the job's locks, waiting for them, skipping the
+// run or failing while another run holds them as the lock policy says
+func acquireJobLock(ctx context.Context, conf config.Configuration, opts backupOptions) (*jobLock, error) {
+  started := time.Now()
+  for {
+    held, err := tryJobLock(ctx, conf, opts)
+    if !errors.Is(err, lock.ErrLocked) {
+      return held, err
+    }
+
+    switch opts.Lock.Policy {
+    case LOCK_SKIP:
+      opts.logger().Info("Another run holds the lock, skipping", logging.Err(err))
+      return nil, errLockSkipped
+    case LOCK_FAIL:
+      return nil, withExitCode(EXIT_LOCKED, err)
+    }
+
+    wait := LOCK_POLL_INTERVAL
+    if opts.Lock.Timeout > 0 {
+      remaining := opts.Lock.Timeout - time.Since(started)
+      if remaining <= 0 {
+        return nil, withExitCode(EXIT_LOCKED, errors.New("Timed out waiting for the lock: " + err.Error()))
+      }
+      if remaining < wait {
+        wait = remaining
+      }
+    }
+
+    opts.logger().Info("Waiting for another run to release the lock", logging.Err(err))
+    select {
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    case <-time.After(wait):
+    }
+  }
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+type manifestEntry struct {
+  Name string
+  Size int64
+  Digest string
+}
+
+// manifest maps archive entry names to their size and content digest
+type manifest map[string]manifestEntry
+
+// readManifest walks a gzipped tarball and hashes every regular file
+// in it into m without writing anything to disk. The files an
+// incremental archive records as deleted are removed from m, so reading
+// a chain in order leaves the manifest of its last backup.
+func readManifest(r io.Reader, m manifest) error {
+  gr, err := gzip.NewReader(r)
+  if err != nil {
+    return err
+  }
+  defer gr.Close()
+
+  var meta archiveMeta
+  tr := tar.NewReader(gr)
+  for {
+    header, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+
+    if header.Name == ARCHIVE_META_NAME {
+      err = json.NewDecoder(tr).Decode(&meta)
+      if err != nil {
+        return err
+      }
+      continue
+    }
+
+    if header.Typeflag != tar.TypeReg {
+      continue
+    }
+
+    h := sha1.New()
+    size, err := io.Copy(h, tr)
+    if err != nil {
+      return err
+    }
+
+    m[header.Name] = manifestEntry{
+      Name: header.Name,
+      Size: size,
+      Digest: hex.EncodeToString(h.Sum(nil)),
+    }
+  }
+
+  for _, deleted := range meta.Deleted {
+    delete(m, deleted)
+  }
+
+  return nil
+}
+
+type manifestChange struct {
+  Kind string
+  Name string
+  OldSize int64
+  NewSize int64
+}
+
+// compareManifests returns the entries added, removed or modified going
+// from a to b
+func compareManifests(a manifest, b manifest) []manifestChange {
+  var changes []manifestChange
+
+  for name, oldEntry := range a {
+    newEntry, ok := b[name]
+    if !ok {
+      changes = append(changes, manifestChange{
+        Kind: "removed",
+        Name: name,
+        OldSize: oldEntry.Size,
+      })
+      continue
+    }
+
+    if oldEntry.Size != newEntry.Size || oldEntry.Digest != newEntry.Digest {
+      changes = append(changes, manifestChange{
+        Kind: "modified",
+        Name: name,
+        OldSize: oldEntry.Size,
+        NewSize: newEntry.Size,
+      })
+    }
+  }
+
+  for name, newEntry := range b {
+    if _, ok := a[name]; !ok {
+      changes = append(changes, manifestChange{
+        Kind: "added",
+        Name: name,
+        NewSize: newEntry.Size,
+      })
+    }
+  }
+
+  return changes
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/metrics"
+)
+
+const LAST_SUCCESS_METRIC = "backup_last_success_timestamp_seconds"
+const LAST_RUN_METRIC = "backup_last_run_timestamp_seconds"
+const RUNS_METRIC = "backup_runs_total"
+const PHASE_DURATION_METRIC = "backup_phase_duration_seconds"
+const FILES_METRIC = "backup_files"
+const ARCHIVED_BYTES_METRIC = "backup_archived_bytes"
+const ARCHIVE_SIZE_METRIC = "backup_archive_size_bytes"
+const UPLOADED_BYTES_METRIC = "backup_uploaded_bytes_total"
+const UPLOAD_RETRIES_METRIC = "backup_upload_retries_total"
+const UPLOAD_FAILURES_METRIC = "backup_upload_failures_total"
+
+const ARCHIVE_PHASE = "archive"
+const COMPRESS_PHASE = "compress"
+const UPLOAD_PHASE = "upload"
+const PRUNE_PHASE = "prune"
+
+func init() {
+  m := metrics.Default
+  m.Describe(LAST_SUCCESS_METRIC, metrics.GAUGE, "Unix time of the last successful backup")
+  m.Describe(LAST_RUN_METRIC, metrics.GAUGE, "Unix time the last backup finished, successful or not")
+  m.Describe(RUNS_METRIC, metrics.COUNTER, "Backup runs by outcome")
+  m.Describe(PHASE_DURATION_METRIC, metrics.GAUGE, "Seconds the last backup spent in each phase, upload and prune per destination")
+  m.Describe(FILES_METRIC, metrics.GAUGE, "Files included in the last archive")
+  m.Describe(ARCHIVED_BYTES_METRIC, metrics.GAUGE, "Uncompressed bytes of the files in the last archive")
+  m.Describe(ARCHIVE_SIZE_METRIC, metrics.GAUGE, "Size of the last archive")
+  m.Describe(UPLOADED_BYTES_METRIC, metrics.COUNTER, "Bytes uploaded to each destination")
+  m.Describe(UPLOAD_RETRIES_METRIC, metrics.COUNTER, "Retries of queued uploads to each destination")
+  m.Describe(UPLOAD_FAILURES_METRIC, metrics.COUNTER, "Failed uploads to each destination")
+}
+
+func recordPhase(job string, phase string, destination string, d time.Duration) {
+  metrics.Default.Set(PHASE_DURATION_METRIC, d.Seconds(), "job", job, "phase", phase, "destination", destination)
+}
+
+// recordRun counts a finished run by its history outcome. Runs whose
+// uploads were queued did not reach every destination, so they do not
+// count as the last success.
+func recordRun(job string, outcome string) {
+  now := float64(time.Now().Unix())
+  metrics.Default.Set(LAST_RUN_METRIC, now, "job", job)
+  metrics.Default.Add(RUNS_METRIC, 1, "job", job, "status", outcome)
+
+  switch outcome {
+  case "success", "skipped":
+    metrics.Default.Set(LAST_SUCCESS_METRIC, now, "job", job)
+  }
+}
+
+// writeMetricsTextfile leaves the metrics where the node_exporter
+// textfile collector picks them up, one file per job so one-shot runs
+// of different jobs do not overwrite each other
+func writeMetricsTextfile(conf config.Configuration, job string) error {
+  if conf.Metrics.TextfileDirectory == "" {
+    return nil
+  }
+
+  name := "backup.prom"
+  if job != "" {
+    name = "backup_" + job + ".prom"
+  }
+
+  return metrics.Default.WriteTextfile(filepath.Join(conf.Metrics.TextfileDirectory, name))
+}
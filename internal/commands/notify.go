@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/hooks"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/notify"
+	"github.com/jdollar/backup/internal/storage"
+)
+
+func newNotifier(conf config.Configuration, name string) (*notify.Notifier, error) {
+  notifierConf, ok := conf.Notifiers[name]
+  if !ok {
+    return nil, errors.New("Unknown notifier " + name)
+  }
+
+  return notify.New(notify.Opts{
+    Type: notifierConf.Type,
+    Url: notifierConf.Url,
+    Template: notifierConf.Template,
+    Subject: notifierConf.Subject,
+    SmtpHost: notifierConf.SmtpHost,
+    SmtpPort: notifierConf.SmtpPort,
+    Username: notifierConf.Username,
+    Password: notifierConf.Password,
+    From: notifierConf.From,
+    To: notifierConf.To,
+  })
+}
+
+func outcomeNotifiers(notifyConf config.NotifyConfiguration, outcome string) []string {
+  switch outcome {
+  case notify.SUCCESS:
+    return notifyConf.Success
+  case notify.FAILURE:
+    return notifyConf.Failure
+  case notify.QUEUED:
+    return notifyConf.Queued
+  }
+
+  return nil
+}
+
+// objectLink points at an uploaded file, box files link to the web app
+func objectLink(conf config.Configuration, destination string, object storage.Object) string {
+  destType := BOX_DESTINATION
+  if destConf, ok := conf.Destinations[destination]; ok {
+    destType = destConf.Type
+  }
+
+  if destType == "box" {
+    return "https://app.box.com/file/" + object.Id
+  }
+
+  return object.Id
+}
+
+// notifyRun sends the notifications configured for the outcome of a
+// run. Failing to notify is logged and never fails the backup.
+func notifyRun(conf config.Configuration, opts backupOptions, env hooks.Env, results []destinationResult, duration time.Duration, runErr error) {
+  outcome := notify.SUCCESS
+  switch {
+  case runErr != nil:
+    outcome = notify.FAILURE
+  case env.Status == "queued":
+    outcome = notify.QUEUED
+  case env.Status == "skipped":
+    // Nothing changed, so there is nothing worth telling anyone
+    return
+  }
+
+  names := outcomeNotifiers(opts.Notify, outcome)
+  if len(names) == 0 {
+    return
+  }
+
+  host, _ := os.Hostname()
+  event := notify.Event{
+    Job: opts.Job,
+    Host: host,
+    Outcome: outcome,
+    Time: time.Now(),
+    Archive: env.ArchiveName,
+    ArchiveSize: env.ArchiveSize,
+    Duration: duration.Round(time.Second),
+  }
+  if runErr != nil {
+    event.Error = runErr.Error()
+  }
+
+  for _, result := range results {
+    destination := notify.Destination{
+      Name: result.Name,
+    }
+    for _, object := range result.Objects {
+      destination.Links = append(destination.Links, objectLink(conf, result.Name, object))
+    }
+    if result.Err != nil {
+      destination.Error = result.Err.Error()
+    }
+    event.Destinations = append(event.Destinations, destination)
+  }
+
+  for _, name := range names {
+    logger := opts.logger().With("notifier", name, "outcome", outcome)
+
+    notifier, err := newNotifier(conf, name)
+    if err == nil {
+      err = notifier.Notify(event)
+    }
+    if err != nil {
+      logger.Error("Error sending notification", logging.Err(err))
+      continue
+    }
+
+    logger.Debug("Sent notification")
+  }
+}
+
+// checkNotifiers reports notifiers that are referenced but not usable
+// before any backup runs
+func checkNotifiers(conf config.Configuration, notifyConf config.NotifyConfiguration) error {
+  for _, names := range [][]string{notifyConf.Success, notifyConf.Failure, notifyConf.Queued} {
+    for _, name := range names {
+      _, err := newNotifier(conf, name)
+      if err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
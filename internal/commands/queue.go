@@ -0,0 +1,354 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/lock"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+)
+
+// QUEUE_MIN_BACKOFF and QUEUE_MAX_BACKOFF bound the wait between
+// attempts at a queued upload, which doubles after every failure
+const QUEUE_MIN_BACKOFF = time.Minute
+const QUEUE_MAX_BACKOFF = 6 * time.Hour
+
+// queuedUpload is a destination that is missing a job's backups from an
+// output directory. Draining it syncs all of the job's backups there,
+// so there is one entry per job, destination and directory however
+// many runs failed.
+type queuedUpload struct {
+  Job string `json:"job"`
+  Destination string `json:"destination"`
+  OutputDirectory string `json:"output_directory"`
+  BackupLimit int64 `json:"backup_limit"`
+  Added time.Time `json:"added"`
+  Attempts int `json:"attempts"`
+  NextAttempt time.Time `json:"next_attempt"`
+  LastError string `json:"last_error"`
+}
+
+func (u queuedUpload) key() string {
+  return u.Job + "|" + u.Destination + "|" + u.OutputDirectory
+}
+
+type uploadQueue struct {
+  Uploads []queuedUpload `json:"uploads"`
+}
+
+// queueMu guards the queue file against the daemon's concurrent jobs,
+// lockUploadQueue against other processes. draining tracks entries
+// being retried so they are not picked twice.
+var queueMu sync.Mutex
+var draining = map[string]bool{}
+
+func uploadQueuePath() (string, error) {
+  configDir, err := config.Directory()
+  if err != nil {
+    return "", err
+  }
+
+  return filepath.Join(configDir, "upload-queue.json"), nil
+}
+
+// lockUploadQueue holds queueMu and a file lock next to the queue until
+// the returned function is called
+func lockUploadQueue() (func(), error) {
+  path, err := uploadQueuePath()
+  if err != nil {
+    return nil, err
+  }
+
+  queueMu.Lock()
+  fileLock, err := lock.LockExclusive(path + ".lock")
+  if err != nil {
+    queueMu.Unlock()
+    return nil, err
+  }
+
+  return func() {
+    fileLock.Unlock()
+    queueMu.Unlock()
+  }, nil
+}
+
+func loadUploadQueue() (uploadQueue, error) {
+  var queue uploadQueue
+
+  path, err := uploadQueuePath()
+  if err != nil {
+    return queue, err
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return queue, nil
+    }
+    return queue, err
+  }
+
+  err = json.Unmarshal(data, &queue)
+  return queue, err
+}
+
+func saveUploadQueue(queue uploadQueue) error {
+  path, err := uploadQueuePath()
+  if err != nil {
+    return err
+  }
+
+  data, err := json.MarshalIndent(queue, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  tmpPath := path + ".tmp"
+  err = ioutil.WriteFile(tmpPath, data, 0644)
+  if err != nil {
+    return err
+  }
+
+  return os.Rename(tmpPath, path)
+}
+
+// updateUploadQueue applies fn to the queue on disk while holding the
+// queue lock
+func updateUploadQueue(fn func(*uploadQueue)) error {
+  unlock, err := lockUploadQueue()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+
+  queue, err := loadUploadQueue()
+  if err != nil {
+    return err
+  }
+
+  fn(&queue)
+  return saveUploadQueue(queue)
+}
+
+func queueBackoff(attempts int) time.Duration {
+  backoff := QUEUE_MIN_BACKOFF
+  for i := 1; i < attempts && backoff < QUEUE_MAX_BACKOFF; i++ {
+    backoff *= 2
+  }
+
+  if backoff > QUEUE_MAX_BACKOFF {
+    return QUEUE_MAX_BACKOFF
+  }
+
+  return backoff
+}
+
+// recordUploadResults queues the destinations that failed so later
+// runs retry them. A destination that succeeded has been synced, which
+// clears any entry it had queued.
+func recordUploadResults(conf config.Configuration, opts backupOptions, results []destinationResult) error {
+  now := time.Now()
+
+  return updateUploadQueue(func(queue *uploadQueue) {
+    for _, result := range results {
+      upload := queuedUpload{
+        Job: opts.Job,
+        Destination: result.Name,
+        OutputDirectory: opts.OutputDirectory,
+        BackupLimit: destinationLimit(conf, result.Name, opts.BackupLimit),
+        Added: now,
+        Attempts: 1,
+        NextAttempt: now.Add(queueBackoff(1)),
+      }
+
+      var remaining []queuedUpload
+      found := false
+      for _, existing := range queue.Uploads {
+        if existing.key() == upload.key() {
+          if result.Err == nil {
+            continue
+          }
+
+          existing.LastError = result.Err.Error()
+          found = true
+        }
+        remaining = append(remaining, existing)
+      }
+
+      if result.Err != nil && !found {
+        opts.logger().Warn("Queued upload for a later retry", "destination", result.Name)
+        upload.LastError = result.Err.Error()
+        remaining = append(remaining, upload)
+      }
+
+      queue.Uploads = remaining
+    }
+  })
+}
+
+// takeDueUploads returns the due entries of the jobs match accepts and
+// marks them as draining
+func takeDueUploads(match func(job string) bool) ([]queuedUpload, error) {
+  var due []queuedUpload
+  now := time.Now()
+
+  unlock, err := lockUploadQueue()
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+
+  queue, err := loadUploadQueue()
+  if err != nil {
+    return nil, err
+  }
+
+  for _, upload := range queue.Uploads {
+    if match(upload.Job) && !now.Before(upload.NextAttempt) && !draining[upload.key()] {
+      draining[upload.key()] = true
+      due = append(due, upload)
+    }
+  }
+
+  return due, nil
+}
+
+func releaseDueUploads(uploads []queuedUpload) {
+  queueMu.Lock()
+  defer queueMu.Unlock()
+
+  for _, upload := range uploads {
+    delete(draining, upload.key())
+  }
+}
+
+// retryUploads syncs the entries' destinations again, the caller holds
+// their job's lock. Entries that fail again are pushed back with a
+// longer backoff.
+func retryUploads(ctx context.Context, conf config.Configuration, uploads []queuedUpload) error {
+  defer releaseDueUploads(uploads)
+
+  for _, upload := range uploads {
+    logger := jobLogger(upload.Job).With("destination", upload.Destination)
+
+    logger.Info("Retrying queued upload", "attempt", upload.Attempts + 1)
+    metrics.Default.Add(UPLOAD_RETRIES_METRIC, 1, "job", upload.Job, "destination", upload.Destination)
+    _, uploadErr := exportToDestination(ctx, upload.Job, conf, upload.Destination, upload.OutputDirectory, upload.BackupLimit)
+    if uploadErr != nil {
+      logger.Warn("Queued upload failed again", logging.Err(uploadErr))
+    } else {
+      logger.Info("Queued upload finished")
+    }
+
+    err := updateUploadQueue(func(queue *uploadQueue) {
+      var remaining []queuedUpload
+      for _, existing := range queue.Uploads {
+        if existing.key() == upload.key() {
+          if uploadErr == nil {
+            continue
+          }
+
+          existing.Attempts++
+          existing.NextAttempt = time.Now().Add(queueBackoff(existing.Attempts))
+          existing.LastError = uploadErr.Error()
+        }
+        remaining = append(remaining, existing)
+      }
+      queue.Uploads = remaining
+    })
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// drainJobUploads retries the job's queued uploads that are due, from a
+// run that already holds the job's lock
+func drainJobUploads(ctx context.Context, conf config.Configuration, job string) error {
+  due, err := takeDueUploads(func(uploadJob string) bool {
+    return uploadJob == job
+  })
+  if err != nil {
+    return err
+  }
+
+  return retryUploads(ctx, conf, due)
+}
+
+// drainUploadQueue retries every queued upload that is due. Retrying
+// prunes the destination, so each job's entries are only drained while
+// holding its lock, those of a job that is running are left to it.
+func drainUploadQueue(ctx context.Context, conf config.Configuration) error {
+  due, err := takeDueUploads(func(string) bool {
+    return true
+  })
+  if err != nil {
+    return err
+  }
+
+  var jobs []string
+  byJob := map[string][]queuedUpload{}
+  for _, upload := range due {
+    if _, ok := byJob[upload.Job]; !ok {
+      jobs = append(jobs, upload.Job)
+    }
+    byJob[upload.Job] = append(byJob[upload.Job], upload)
+  }
+
+  for _, job := range jobs {
+    uploads := byJob[job]
+    if ctx.Err() != nil {
+      releaseDueUploads(uploads)
+      continue
+    }
+
+    opts, err := queueLockOptions(conf, job)
+    var held *jobLock
+    if err == nil {
+      held, err = tryJobLock(ctx, conf, opts)
+    }
+    if err != nil {
+      if errors.Is(err, lock.ErrLocked) {
+        opts.logger().Debug("Job is running, leaving its queued uploads to it")
+      } else {
+        opts.logger().Warn("Not retrying queued uploads", logging.Err(err))
+      }
+      releaseDueUploads(uploads)
+      continue
+    }
+
+    err = retryUploads(ctx, conf, uploads)
+    held.release(ctx, opts.logger())
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// queueLockOptions are the options to lock the job an entry was queued
+// by. Jobs no longer in the configuration and backups made outside a
+// job lock as runs outside a job do.
+func queueLockOptions(conf config.Configuration, job string) (backupOptions, error) {
+  if jobConf, ok := conf.Jobs[job]; ok {
+    return backupOptionsFromJob(conf, job, jobConf)
+  }
+
+  lockOpts, err := lockOptionsFromConfig(conf.Lock)
+  return backupOptions{
+    Job: job,
+    Destinations: []string{BOX_DESTINATION},
+    Lock: lockOpts,
+  }, err
+}
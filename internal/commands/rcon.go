@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/rcon"
+)
+
+const RCON_DIAL_TIMEOUT = 10 * time.Second
+
+func rconAddress(rconConf config.RconConfiguration) string {
+  port := rconConf.Port
+  if port == 0 {
+    port = 25575
+  }
+
+  return net.JoinHostPort(rconConf.Host, strconv.Itoa(port))
+}
+
+// waitForSave reads server output until the flush reports the world as
+// saved. Depending on the server version that is either the response to
+// save-all itself or a later message.
+func waitForSave(client *rcon.Client, response string, timeout time.Duration) error {
+  deadline := time.Now().Add(timeout)
+  for !strings.Contains(response, "Saved the game") {
+    remaining := time.Until(deadline)
+    if remaining <= 0 {
+      return errors.New("Timed out waiting for the server to save the world")
+    }
+
+    packet, err := client.ReadPacket(remaining)
+    if err != nil {
+      return err
+    }
+    response = packet.Body
+  }
+
+  return nil
+}
+
+// pauseWorldSaving flushes the world to disk and turns off autosaving
+// so region files do not change while they are archived. The returned
+// function turns saving back on and must always be called.
+func pauseWorldSaving(rconConf config.RconConfiguration) (func(), error) {
+  timeout := 5 * time.Minute
+  if rconConf.SaveTimeout != "" {
+    parsed, err := time.ParseDuration(rconConf.SaveTimeout)
+    if err != nil {
+      return nil, err
+    }
+    timeout = parsed
+  }
+
+  address := rconAddress(rconConf)
+  slog.Info("Connecting to rcon", "address", address)
+  client, err := rcon.Dial(address, rconConf.Password, RCON_DIAL_TIMEOUT)
+  if err != nil {
+    return nil, err
+  }
+
+  resume := func() {
+    slog.Info("Turning world saving back on")
+    _, err := client.Command("save-on")
+    client.Close()
+    if err == nil {
+      return
+    }
+
+    // The connection may have dropped while archiving, so try once more
+    // on a fresh one rather than leaving the server with saving off
+    slog.Warn("Error turning saving back on, retrying", logging.Err(err))
+    retry, err := rcon.Dial(address, rconConf.Password, RCON_DIAL_TIMEOUT)
+    if err != nil {
+      slog.Error("Error reconnecting to rcon, world saving is still off", logging.Err(err))
+      return
+    }
+    defer retry.Close()
+
+    _, err = retry.Command("save-on")
+    if err != nil {
+      slog.Error("Error turning saving back on, world saving is still off", logging.Err(err))
+    }
+  }
+
+  slog.Info("Turning world saving off")
+  _, err = client.Command("save-off")
+  if err != nil {
+    client.Close()
+    return nil, err
+  }
+
+  slog.Info("Flushing world to disk")
+  response, err := client.Command("save-all flush")
+  if err == nil {
+    err = waitForSave(client, response, timeout)
+  }
+  if err != nil {
+    resume()
+    return nil, err
+  }
+  slog.Info("World saved")
+
+  return resume, nil
+}
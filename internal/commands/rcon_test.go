@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/rcon"
+	"github.com/jdollar/backup/internal/rcon/rcontest"
+)
+
+// minecraftServer answers the saving commands the way a Minecraft
+// server does. flush handles save-all flush.
+func minecraftServer(t *testing.T, flush rcontest.Handler) (*rcontest.Server, config.RconConfiguration) {
+  t.Helper()
+
+  server, err := rcontest.NewServer("secret", func(conn *rcontest.Conn, request rcon.Packet) {
+    switch request.Body {
+    case "save-off":
+      conn.Reply(request, "Automatic saving is now disabled")
+    case "save-on":
+      conn.Reply(request, "Automatic saving is now enabled")
+    case "save-all flush":
+      flush(conn, request)
+    default:
+      conn.Reply(request, "Unknown command")
+    }
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(server.Close)
+
+  host, port, err := net.SplitHostPort(server.Addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  portNumber, err := strconv.Atoi(port)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return server, config.RconConfiguration{
+    Host: host,
+    Port: portNumber,
+    Password: "secret",
+    SaveTimeout: "1s",
+  }
+}
+
+func savedImmediately(conn *rcontest.Conn, request rcon.Packet) {
+  conn.Reply(request, "Saving the game (this may take a moment!)Saved the game")
+}
+
+func checkCommands(t *testing.T, server *rcontest.Server, want ...string) {
+  t.Helper()
+
+  // The server records a command before replying, so every command the
+  // client got an answer to is listed
+  got := server.Commands()
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("server ran %q, want %q", got, want)
+  }
+}
+
+func TestPauseWorldSaving(t *testing.T) {
+  server, rconConf := minecraftServer(t, savedImmediately)
+
+  resume, err := pauseWorldSaving(rconConf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkCommands(t, server, "save-off", "save-all flush")
+
+  resume()
+  checkCommands(t, server, "save-off", "save-all flush", "save-on")
+}
+
+func TestPauseWorldSavingWaitsForSave(t *testing.T) {
+  server, rconConf := minecraftServer(t, func(conn *rcontest.Conn, request rcon.Packet) {
+    // Older servers report the save as a separate message once the
+    // region files are written
+    conn.Reply(request, "Saving the game (this may take a moment!)")
+    time.Sleep(50 * time.Millisecond)
+    conn.Send(rcon.Packet{
+      Type: rcon.SERVERDATA_RESPONSE_VALUE,
+      Body: "Saved the game",
+    })
+  })
+
+  resume, err := pauseWorldSaving(rconConf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  resume()
+
+  checkCommands(t, server, "save-off", "save-all flush", "save-on")
+}
+
+func TestPauseWorldSavingResumesAfterSaveTimeout(t *testing.T) {
+  server, rconConf := minecraftServer(t, func(conn *rcontest.Conn, request rcon.Packet) {
+    conn.Reply(request, "Saving the game (this may take a moment!)")
+  })
+  rconConf.SaveTimeout = "100ms"
+
+  _, err := pauseWorldSaving(rconConf)
+  if err == nil {
+    t.Fatal("expected the save to time out")
+  }
+
+  checkCommands(t, server, "save-off", "save-all flush", "save-on")
+}
+
+func TestPauseWorldSavingResumesOnNewConnection(t *testing.T) {
+  // The connection drops during the flush, so save-on only reaches the
+  // server on the retry
+  server, rconConf := minecraftServer(t, func(conn *rcontest.Conn, request rcon.Packet) {
+    conn.Close()
+  })
+
+  _, err := pauseWorldSaving(rconConf)
+  if err == nil {
+    t.Fatal("expected the flush to fail")
+  }
+
+  checkCommands(t, server, "save-off", "save-all flush", "save-on")
+}
+
+func TestPauseWorldSavingWrongPassword(t *testing.T) {
+  server, rconConf := minecraftServer(t, savedImmediately)
+  rconConf.Password = "wrong"
+
+  _, err := pauseWorldSaving(rconConf)
+  if err != rcon.ErrAuthFailed {
+    t.Errorf("got %v, want %v", err, rcon.ErrAuthFailed)
+  }
+
+  checkCommands(t, server)
+}
+
+func TestWaitForSave(t *testing.T) {
+  server, rconConf := minecraftServer(t, savedImmediately)
+
+  client, err := rcon.Dial(server.Addr, rconConf.Password, time.Second)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer client.Close()
+
+  // Nothing is read when the response already reports the save
+  err = waitForSave(client, "Saved the game", time.Second)
+  if err != nil {
+    t.Error(err)
+  }
+
+  err = waitForSave(client, "Saving the game (this may take a moment!)", 50 * time.Millisecond)
+  if err == nil {
+    t.Error("expected waiting without a save message to time out")
+  }
+}
@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/files"
+	"github.com/jdollar/backup/internal/repository"
+	"github.com/jdollar/backup/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+const REPOSITORY_FLAG = "repository"
+
+// BOX_REPOSITORY is the repository flag value that stores the
+// repository in box next to the regular backup folder
+const BOX_REPOSITORY = "box"
+
+func openRepositoryBackend(ctx context.Context, conf config.Configuration, location string) (storage.Backend, error) {
+  if location != BOX_REPOSITORY {
+    return storage.NewLocal(location)
+  }
+
+  client, err := newBoxClient(ctx, conf)
+  if err != nil {
+    return nil, err
+  }
+
+  folder, err := findOrCreateFolder(ctx, &client, conf.Box.BackupFolderName + "Repository")
+  if err != nil {
+    return nil, err
+  }
+
+  return storage.NewBox(&client, folder), nil
+}
+
+func openRepository(conf config.Configuration, c *cli.Context) (*repository.Repository, error) {
+  backend, err := openRepositoryBackend(c.Context, conf, c.String(REPOSITORY_FLAG))
+  if err != nil {
+    return nil, err
+  }
+
+  return repository.Open(c.Context, backend)
+}
+
+func repoInitAction(conf config.Configuration, c *cli.Context) error {
+  backend, err := openRepositoryBackend(c.Context, conf, c.String(REPOSITORY_FLAG))
+  if err != nil {
+    return err
+  }
+
+  err = repository.Init(c.Context, backend)
+  if err != nil {
+    return err
+  }
+
+  slog.Info("Initialized repository")
+  return nil
+}
+
+func repoBackupAction(conf config.Configuration, c *cli.Context) error {
+  sources, err := collectFiles(c.Args().Slice(), nil)
+  if err != nil {
+    return err
+  }
+
+  var filenames []string
+  for _, source := range sources {
+    filenames = append(filenames, source.Name)
+  }
+
+  repo, err := openRepository(conf, c)
+  if err != nil {
+    return err
+  }
+
+  snapshot, stats, err := repo.Backup(c.Context, c.Args().Slice(), filenames, time.Now())
+  if err != nil {
+    return err
+  }
+
+  slog.Info(
+    "Saved snapshot",
+    "snapshot", snapshot.Name,
+    "files", stats.Files,
+    "size", stats.Bytes,
+    "new_chunks", stats.NewChunks,
+    "uploaded", stats.NewBytes,
+    "packs", stats.Packs,
+  )
+
+  if conf.BackupLimit > 0 {
+    pruneStats, err := repo.Prune(c.Context, int(conf.BackupLimit))
+    if err != nil {
+      return err
+    }
+
+    slog.Info("Pruned repository", "snapshots", pruneStats.Snapshots, "packs", pruneStats.Packs)
+  }
+
+  return nil
+}
+
+func repoSnapshotsAction(conf config.Configuration, c *cli.Context) error {
+  repo, err := openRepository(conf, c)
+  if err != nil {
+    return err
+  }
+
+  snapshots, err := repo.Snapshots(c.Context)
+  if err != nil {
+    return err
+  }
+
+  for _, snapshot := range snapshots {
+    var size int64
+    for _, node := range snapshot.Nodes {
+      size += node.Size
+    }
+
+    fmt.Printf(
+      "%s  %s  %d files  %s\n",
+      snapshot.Name,
+      snapshot.Time.Local().Format(time.RFC3339),
+      len(snapshot.Nodes),
+      files.FormatBytes(size),
+    )
+  }
+
+  return nil
+}
+
+func repoRestoreAction(conf config.Configuration, c *cli.Context) error {
+  if c.NArg() != 1 {
+    return errors.New("restore requires the snapshot to restore")
+  }
+
+  repo, err := openRepository(conf, c)
+  if err != nil {
+    return err
+  }
+
+  snapshot, err := repo.LoadSnapshot(c.Context, c.Args().First())
+  if err != nil {
+    return err
+  }
+
+  return repo.Restore(c.Context, snapshot, c.String(TARGET_DIRECTORY_FLAG))
+}
+
+func repoPruneAction(conf config.Configuration, c *cli.Context) error {
+  // Pruning to nothing would delete every snapshot along with its packs
+  if conf.BackupLimit <= 0 {
+    return withExitCode(EXIT_CONFIG, errors.New("Refusing to prune without a backup_limit above 0"))
+  }
+
+  repo, err := openRepository(conf, c)
+  if err != nil {
+    return err
+  }
+
+  stats, err := repo.Prune(c.Context, int(conf.BackupLimit))
+  if err != nil {
+    return err
+  }
+
+  slog.Info("Pruned repository", "snapshots", stats.Snapshots, "packs", stats.Packs)
+  return nil
+}
+
+func NewRepoCommand(conf config.Configuration) *cli.Command {
+  action := func(fn func(config.Configuration, *cli.Context) error) cli.ActionFunc {
+    return func(c *cli.Context) error {
+      return fn(conf, c)
+    }
+  }
+
+  return &cli.Command{
+    Name: "repo",
+    Usage: "Deduplicated backups stored as content defined chunks",
+    Flags: []cli.Flag{
+      &cli.StringFlag{
+        Name: REPOSITORY_FLAG,
+        Aliases: []string{"r"},
+        Usage: "Directory holding the repository, or \"box\" to store it in box",
+        Value: BOX_REPOSITORY,
+      },
+    },
+    Subcommands: []*cli.Command{
+      {
+        Name: "init",
+        Usage: "Create a new repository",
+        Action: action(repoInitAction),
+      },
+      {
+        Name: "backup",
+        Usage: "Store a new snapshot of the given files and prune old ones",
+        ArgsUsage: "<files...>",
+        Action: action(repoBackupAction),
+      },
+      {
+        Name: "snapshots",
+        Usage: "List snapshots in the repository",
+        Action: action(repoSnapshotsAction),
+      },
+      {
+        Name: "restore",
+        Usage: "Restore a snapshot",
+        ArgsUsage: "<snapshot>",
+        Flags: []cli.Flag{
+          &cli.StringFlag{
+            Name: TARGET_DIRECTORY_FLAG,
+            Aliases: []string{"t"},
+            Usage: "Directory to restore the files into",
+            Required: true,
+          },
+        },
+        Action: action(repoRestoreAction),
+      },
+      {
+        Name: "prune",
+        Usage: "Remove snapshots beyond the backup limit and unreferenced packs",
+        Action: action(repoPruneAction),
+      },
+    },
+  }
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/urfave/cli/v2"
+)
+
+const TARGET_DIRECTORY_FLAG = "target"
+
+// MAX_CHAIN_LENGTH guards against cycles in corrupted chain metadata
+const MAX_CHAIN_LENGTH = 1000
+
+// readArchiveMeta returns the chain metadata of an incremental archive,
+// or nil for a full backup
+func readArchiveMeta(locator *backupLocator, name string) (*archiveMeta, error) {
+  r, err := locator.open(name)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+
+  gr, err := gzip.NewReader(r)
+  if err != nil {
+    return nil, err
+  }
+  defer gr.Close()
+
+  tr := tar.NewReader(gr)
+  header, err := tr.Next()
+  if err == io.EOF {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  if header.Name != ARCHIVE_META_NAME {
+    return nil, nil
+  }
+
+  var meta archiveMeta
+  err = json.NewDecoder(tr).Decode(&meta)
+  if err != nil {
+    return nil, err
+  }
+
+  return &meta, nil
+}
+
+// siblingBackup resolves a backup referenced by name from another
+// backup, looking next to it first when it lives on the local disk
+func siblingBackup(from string, name string) string {
+  if localBackupExists(filepath.Dir(from), filepath.Base(from)) {
+    return filepath.Join(filepath.Dir(from), name)
+  }
+
+  return name
+}
+
+// resolveChain returns the backups that need to be replayed to restore
+// name, starting with its full backup
+func resolveChain(locator *backupLocator, name string) ([]string, error) {
+  var chain []string
+
+  current := name
+  for i := 0; i < MAX_CHAIN_LENGTH; i++ {
+    chain = append([]string{current}, chain...)
+
+    meta, err := readArchiveMeta(locator, current)
+    if err != nil {
+      return nil, err
+    }
+
+    if meta == nil {
+      return chain, nil
+    }
+
+    current = siblingBackup(current, meta.Parent)
+  }
+
+  return nil, errors.New("Incremental chain for " + name + " is too long or loops back on itself")
+}
+
+// safeJoin keeps archive entries from escaping the restore target
+func safeJoin(target string, name string) string {
+  cleaned := filepath.Clean(string(filepath.Separator) + name)
+  return filepath.Join(target, cleaned)
+}
+
+func extractFile(tr *tar.Reader, header *tar.Header, path string) error {
+  err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+  if err != nil {
+    return err
+  }
+
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, header.FileInfo().Mode().Perm())
+  if err != nil {
+    return err
+  }
+
+  _, err = io.Copy(file, tr)
+  if err != nil {
+    file.Close()
+    return err
+  }
+
+  err = file.Close()
+  if err != nil {
+    return err
+  }
+
+  return os.Chtimes(path, header.ModTime, header.ModTime)
+}
+
+// extractArchive unpacks a backup into target and applies the
+// deletions recorded by an incremental archive
+func extractArchive(r io.Reader, target string) error {
+  gr, err := gzip.NewReader(r)
+  if err != nil {
+    return err
+  }
+  defer gr.Close()
+
+  var meta archiveMeta
+  tr := tar.NewReader(gr)
+  for {
+    header, err := tr.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return err
+    }
+
+    path := safeJoin(target, header.Name)
+
+    switch {
+    case header.Name == ARCHIVE_META_NAME:
+      err = json.NewDecoder(tr).Decode(&meta)
+    case header.Typeflag == tar.TypeDir:
+      err = os.MkdirAll(path, os.ModePerm)
+    case header.Typeflag == tar.TypeReg:
+      slog.Debug("Restoring file", "file", header.Name)
+      err = extractFile(tr, header, path)
+    default:
+      slog.Warn("Skipping unsupported entry", "file", header.Name)
+    }
+
+    if err != nil {
+      return err
+    }
+  }
+
+  for _, deleted := range meta.Deleted {
+    slog.Debug("Removing deleted file", "file", deleted)
+    err := os.Remove(safeJoin(target, deleted))
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func restoreBackup(locator *backupLocator, name string, target string) error {
+  r, err := locator.open(name)
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+
+  slog.Info("Extracting backup", "archive", name)
+  err = extractArchive(r, target)
+  if err != nil {
+    return err
+  }
+
+  // Read whatever trails the tarball so the last volume of a split
+  // archive gets its checksum verified
+  _, err = io.Copy(ioutil.Discard, r)
+  return err
+}
+
+func restoreCommandAction(conf config.Configuration, c *cli.Context) error {
+  if c.NArg() != 1 {
+    return errors.New("restore requires the backup to restore")
+  }
+
+  target := c.String(TARGET_DIRECTORY_FLAG)
+  err := os.MkdirAll(target, os.ModePerm)
+  if err != nil {
+    return err
+  }
+
+  locator := newBackupLocator(c.Context, conf)
+  defer locator.Close()
+
+  chain, err := resolveChain(locator, c.Args().First())
+  if err != nil {
+    return err
+  }
+
+  for _, name := range chain {
+    err = restoreBackup(locator, name, target)
+    if err != nil {
+      return err
+    }
+  }
+
+  slog.Info("Restored backups", "backups", len(chain), "target", target)
+
+  return nil
+}
+
+func NewRestoreCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return restoreCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "restore",
+    Usage: "Restore a backup, replaying its full backup and incremental chain",
+    ArgsUsage: "<backup>",
+    Flags: []cli.Flag{
+      &cli.StringFlag{
+        Name: TARGET_DIRECTORY_FLAG,
+        Aliases: []string{"t"},
+        Usage: "Directory to restore the files into",
+        Required: true,
+      },
+    },
+    Action: commandAction,
+  }
+}
@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/urfave/cli/v2"
+)
+
+const ALL_JOBS_FLAG = "all"
+
+func runJob(ctx context.Context, conf config.Configuration, name string) error {
+  job, ok := conf.Jobs[name]
+  if !ok {
+    return withExitCode(EXIT_CONFIG, errors.New("Unknown job " + name))
+  }
+
+  opts, err := backupOptionsFromJob(conf, name, job)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  started := time.Now()
+  opts.logger().Info("Starting job")
+  err = runBackup(ctx, conf, opts)
+  if err != nil {
+    return err
+  }
+
+  opts.logger().Info("Job finished", "duration", time.Since(started).Round(time.Second).String())
+  return nil
+}
+
+// jobNames returns the jobs named on the command line, or every job in
+// the configuration with --all
+func jobNames(conf config.Configuration, c *cli.Context) ([]string, error) {
+  if !c.Bool(ALL_JOBS_FLAG) {
+    if c.NArg() == 0 {
+      return nil, errors.New(c.Command.Name + " requires a job name or --all")
+    }
+
+    return c.Args().Slice(), nil
+  }
+
+  if c.NArg() > 0 {
+    return nil, errors.New(c.Command.Name + " takes either job names or --all, not both")
+  }
+
+  var names []string
+  for name := range conf.Jobs {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  if len(names) == 0 {
+    return nil, errors.New("No jobs found in the configuration")
+  }
+
+  return names, nil
+}
+
+func runCommandAction(conf config.Configuration, c *cli.Context) error {
+  names, err := jobNames(conf, c)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  // Keep going after a failed job so one broken server does not stop
+  // the others from being backed up
+  var failed []string
+  var codes []int
+  for _, name := range names {
+    // Stop at the job that was interrupted instead of starting the rest
+    if c.Context.Err() != nil {
+      return c.Context.Err()
+    }
+
+    err := runJob(c.Context, conf, name)
+    if err != nil {
+      slog.Error("Job failed", "job", name, logging.Err(err))
+      failed = append(failed, name)
+      codes = append(codes, ExitCode(err))
+    }
+  }
+
+  if len(failed) > 0 {
+    return withExitCode(combinedExitCode(codes), errors.New("Failed jobs: " + strings.Join(failed, ", ")))
+  }
+
+  return nil
+}
+
+func NewRunCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return runCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "run",
+    Usage: "Run backup jobs defined in the configuration file",
+    ArgsUsage: "<jobs...>",
+    Flags: []cli.Flag{
+      &cli.BoolFlag{
+        Name: ALL_JOBS_FLAG,
+        Usage: "Run every job in the configuration",
+      },
+    },
+    Action: commandAction,
+  }
+}
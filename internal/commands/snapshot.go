@@ -0,0 +1,180 @@
+package commands
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const FULL_ARCHIVE_SUFFIX = ".tar.gz"
+const INCREMENTAL_ARCHIVE_SUFFIX = ".inc.tar.gz"
+
+// ARCHIVE_META_NAME is the first entry of every incremental archive and
+// describes where the archive sits in its chain
+const ARCHIVE_META_NAME = ".backup/meta.json"
+
+type snapshotEntry struct {
+  Size int64 `json:"size"`
+  ModTime int64 `json:"mtime"`
+  Inode uint64 `json:"inode"`
+  Hash string `json:"hash"`
+}
+
+// snapshotIndex is the listed-incremental state saved after every
+// incremental mode run. Entries describe the source files as they were
+// when Parent was archived.
+type snapshotIndex struct {
+  Base string `json:"base"`
+  Parent string `json:"parent"`
+  Level int `json:"level"`
+  Entries map[string]snapshotEntry `json:"entries"`
+}
+
+type archiveMeta struct {
+  Type string `json:"type"`
+  Base string `json:"base"`
+  Parent string `json:"parent"`
+  Deleted []string `json:"deleted"`
+}
+
+func isIncrementalArchive(name string) bool {
+  return strings.HasSuffix(name, INCREMENTAL_ARCHIVE_SUFFIX)
+}
+
+func loadSnapshotIndex(path string) (*snapshotIndex, error) {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil, nil
+    }
+    return nil, err
+  }
+
+  var index snapshotIndex
+  err = json.Unmarshal(data, &index)
+  if err != nil {
+    return nil, err
+  }
+
+  return &index, nil
+}
+
+func saveSnapshotIndex(path string, index *snapshotIndex) error {
+  data, err := json.Marshal(index)
+  if err != nil {
+    return err
+  }
+
+  // Write next to the real file and rename so an interrupted run
+  // never leaves a half written index behind
+  tmpPath := path + ".tmp"
+  err = ioutil.WriteFile(tmpPath, data, 0644)
+  if err != nil {
+    return err
+  }
+
+  return os.Rename(tmpPath, path)
+}
+
+func hashFile(filename string) (string, error) {
+  file, err := os.Open(filename)
+  if err != nil {
+    return "", err
+  }
+  defer file.Close()
+
+  h := sha1.New()
+  if _, err := io.Copy(h, file); err != nil {
+    return "", err
+  }
+
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// incrementalPlan is the result of comparing the current source files
+// against the previous snapshot index
+type incrementalPlan struct {
+  Full bool
+  Files []archiveFile
+  Deleted []string
+  Index *snapshotIndex
+}
+
+// planIncremental works out which of the source files need to be
+// archived. Files whose size, modification time and inode match the
+// previous index are skipped without being read, files whose metadata
+// changed are hashed so a touch alone does not pull them in.
+func planIncremental(previous *snapshotIndex, full bool, sources []archiveFile) (incrementalPlan, error) {
+  plan := incrementalPlan{
+    Full: full,
+    Index: &snapshotIndex{
+      Entries: map[string]snapshotEntry{},
+    },
+  }
+
+  previousEntries := map[string]snapshotEntry{}
+  if previous != nil && !full {
+    previousEntries = previous.Entries
+  }
+
+  for _, source := range sources {
+    entry := snapshotEntry{
+      Size: source.Info.Size(),
+      ModTime: source.Info.ModTime().UnixNano(),
+      Inode: fileInode(source.Info),
+    }
+
+    prev, ok := previousEntries[source.Name]
+    if ok && prev.Size == entry.Size && prev.ModTime == entry.ModTime && prev.Inode == entry.Inode {
+      entry.Hash = prev.Hash
+      plan.Index.Entries[source.Name] = entry
+      continue
+    }
+
+    hash, err := hashFile(source.Name)
+    if err != nil {
+      return plan, err
+    }
+    entry.Hash = hash
+    plan.Index.Entries[source.Name] = entry
+
+    if ok && prev.Size == entry.Size && prev.Hash == entry.Hash {
+      continue
+    }
+
+    plan.Files = append(plan.Files, source)
+  }
+
+  for name := range previousEntries {
+    if _, ok := plan.Index.Entries[name]; !ok {
+      plan.Deleted = append(plan.Deleted, name)
+    }
+  }
+
+  return plan, nil
+}
+
+// needsFullBackup decides whether the next incremental mode run has to
+// start a new chain
+func needsFullBackup(previous *snapshotIndex, outputDirectory string, fullEvery int) bool {
+  if previous == nil || previous.Parent == "" {
+    return true
+  }
+
+  if fullEvery > 0 && previous.Level+1 >= fullEvery {
+    return true
+  }
+
+  for _, name := range []string{previous.Base, previous.Parent} {
+    if !localBackupExists(outputDirectory, name) {
+      return true
+    }
+  }
+
+  return false
+}
@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/history"
+	"github.com/urfave/cli/v2"
+)
+
+// statusJobs returns the jobs in the configuration along with any that
+// only have recorded runs
+func statusJobs(conf config.Configuration, store *history.Store) ([]string, error) {
+  seen := map[string]bool{}
+  var jobs []string
+  for name := range conf.Jobs {
+    seen[name] = true
+    jobs = append(jobs, name)
+  }
+
+  recorded, err := store.Jobs()
+  if err != nil {
+    return nil, err
+  }
+
+  for _, name := range recorded {
+    if !seen[name] {
+      jobs = append(jobs, name)
+    }
+  }
+
+  sort.Strings(jobs)
+  return jobs, nil
+}
+
+func printJobStatus(store *history.Store, job string) error {
+  fmt.Println(job + ":")
+
+  runs, err := store.Runs(job, 1)
+  if err != nil {
+    return err
+  }
+
+  if len(runs) == 0 {
+    fmt.Println("  never run")
+    return nil
+  }
+
+  last := runs[0]
+  fmt.Printf("  last run:     %s (%s), %s\n", last.Started.Local().Format(time.RFC3339), formatAge(last.Finished), last.Outcome)
+  if last.Error != "" {
+    fmt.Printf("  error:        %s\n", last.Error)
+  }
+
+  success, err := store.LastSuccess(job)
+  if errors.Is(err, history.ErrNoSuccess) {
+    fmt.Println("  last success: never")
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  archive := success.Archive
+  if archive == "" {
+    archive = "nothing changed since the last archive"
+  }
+  fmt.Printf("  last success: %s (%s), %s\n", success.Finished.Local().Format(time.RFC3339), formatAge(success.Finished), archive)
+
+  return nil
+}
+
+func statusCommandAction(conf config.Configuration, c *cli.Context) error {
+  store, err := historyStore()
+  if err != nil {
+    return err
+  }
+
+  jobs, err := statusJobs(conf, store)
+  if err != nil {
+    return err
+  }
+
+  for _, job := range jobs {
+    err = printJobStatus(store, job)
+    if err != nil {
+      return err
+    }
+  }
+
+  queue, err := loadUploadQueue()
+  if err != nil {
+    return err
+  }
+
+  fmt.Printf("Upload queue: %d pending\n", len(queue.Uploads))
+  for _, upload := range queue.Uploads {
+    job := upload.Job
+    if job == "" {
+      job = "-"
+    }
+
+    fmt.Printf(
+      "  %s  job %s  from %s  queued %s  %d attempts  next %s\n",
+      upload.Destination,
+      job,
+      upload.OutputDirectory,
+      upload.Added.Local().Format(time.RFC3339),
+      upload.Attempts,
+      upload.NextAttempt.Local().Format(time.RFC3339),
+    )
+    fmt.Printf("    last error: %s\n", upload.LastError)
+  }
+
+  return nil
+}
+
+func NewStatusCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return statusCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "status",
+    Usage: "Show the last run and last success of each job and uploads waiting to be retried",
+    Action: commandAction,
+  }
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/jdollar/backup/internal/metrics"
+	"github.com/jdollar/backup/internal/storage"
+)
+
+type streamTarget struct {
+  name string
+  backend storage.StreamingBackend
+  pw *io.PipeWriter
+  failed bool
+  object storage.Object
+  err error
+}
+
+// archiveStream uploads the archive to the destinations while it is
+// written to the output directory. A destination that fails is dropped
+// from the stream without failing the archive, the export after
+// archiving uploads it from the output directory like any destination
+// that is missing the archive.
+type archiveStream struct {
+  job string
+  name string
+  logger *slog.Logger
+  targets []*streamTarget
+  hash hash.Hash
+  size int64
+  wg sync.WaitGroup
+}
+
+func startArchiveStream(ctx context.Context, conf config.Configuration, opts backupOptions, name string) *archiveStream {
+  stream := &archiveStream{
+    job: opts.Job,
+    name: name,
+    logger: opts.logger(),
+    hash: sha1.New(),
+  }
+
+  for _, destName := range opts.Destinations {
+    logger := opts.logger().With("destination", destName, "archive", name)
+    backend, err := openDestination(ctx, conf, destName)
+    if err != nil {
+      logger.Warn("Not streaming to destination", logging.Err(err))
+      continue
+    }
+
+    streaming, ok := backend.(storage.StreamingBackend)
+    if !ok {
+      logger.Info("Destination needs the archive size, uploading it once the archive is complete")
+      continue
+    }
+
+    pr, pw := io.Pipe()
+    target := &streamTarget{
+      name: destName,
+      backend: streaming,
+      pw: pw,
+    }
+    stream.targets = append(stream.targets, target)
+
+    stream.wg.Add(1)
+    go func() {
+      defer stream.wg.Done()
+
+      target.object, target.err = target.backend.SaveStream(ctx, name, pr)
+      // Unblock the archive writer if the upload gave up early
+      pr.CloseWithError(target.err)
+    }()
+  }
+
+  return stream
+}
+
+func (s *archiveStream) Write(p []byte) (int, error) {
+  s.hash.Write(p)
+  s.size += int64(len(p))
+
+  for _, target := range s.targets {
+    if target.failed {
+      continue
+    }
+
+    _, err := target.pw.Write(p)
+    if err != nil {
+      s.logger.Warn("Streaming failed, uploading once the archive is complete", "destination", target.name, "archive", s.name, logging.Err(err))
+      target.failed = true
+    }
+  }
+
+  return len(p), nil
+}
+
+// finish ends the uploads and waits for them, returning the objects
+// stored by destination. When archiving failed the uploads are aborted
+// so no partial archive is left at a destination.
+func (s *archiveStream) finish(ctx context.Context, archiveErr error) map[string]storage.Object {
+  for _, target := range s.targets {
+    if archiveErr != nil {
+      target.pw.CloseWithError(archiveErr)
+    } else {
+      target.pw.Close()
+    }
+  }
+  s.wg.Wait()
+
+  if archiveErr != nil {
+    return nil
+  }
+
+  sum := hex.EncodeToString(s.hash.Sum(nil))
+  streamed := map[string]storage.Object{}
+  for _, target := range s.targets {
+    if target.err != nil || target.failed {
+      continue
+    }
+
+    if target.object.Size != s.size || (target.object.Sha1 != "" && target.object.Sha1 != sum) {
+      s.logger.Warn("Streamed archive does not match, removing the copy", "destination", target.name, "archive", s.name)
+      target.backend.Remove(ctx, s.name)
+      continue
+    }
+
+    s.logger.Info("Streamed archive", "destination", target.name, "archive", s.name, "size", s.size)
+    metrics.Default.Add(UPLOADED_BYTES_METRIC, float64(s.size), "job", s.job, "destination", target.name)
+    streamed[target.name] = target.object
+  }
+
+  return streamed
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/urfave/cli/v2"
+)
+
+func syncJob(ctx context.Context, conf config.Configuration, name string) error {
+  job, ok := conf.Jobs[name]
+  if !ok {
+    return withExitCode(EXIT_CONFIG, errors.New("Unknown job " + name))
+  }
+
+  opts, err := backupOptionsFromJob(conf, name, job)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  held, err := acquireJobLock(ctx, conf, opts)
+  if err == errLockSkipped {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  defer held.release(ctx, opts.logger())
+
+  opts.logger().Info("Syncing job")
+  results := exportToDestinations(ctx, conf, opts)
+
+  err = recordUploadResults(conf, opts, results)
+  if err != nil {
+    return err
+  }
+
+  return destinationsError(opts.logger(), results)
+}
+
+func syncCommandAction(conf config.Configuration, c *cli.Context) error {
+  names, err := jobNames(conf, c)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  var failed []string
+  var codes []int
+  for _, name := range names {
+    // Stop at the job that was interrupted instead of starting the rest
+    if c.Context.Err() != nil {
+      return c.Context.Err()
+    }
+
+    err := syncJob(c.Context, conf, name)
+    if err != nil {
+      slog.Error("Sync failed", "job", name, logging.Err(err))
+      failed = append(failed, name)
+      codes = append(codes, ExitCode(err))
+    }
+  }
+
+  if len(failed) > 0 {
+    return withExitCode(combinedExitCode(codes), errors.New("Failed to sync jobs: " + strings.Join(failed, ", ")))
+  }
+
+  return nil
+}
+
+func NewSyncCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return syncCommandAction(conf, c)
+  }
+
+  return &cli.Command{
+    Name: "sync",
+    Usage: "Upload local backups missing from a job's destinations and apply retention",
+    ArgsUsage: "<jobs...>",
+    Flags: []cli.Flag{
+      &cli.BoolFlag{
+        Name: ALL_JOBS_FLAG,
+        Usage: "Sync every job in the configuration",
+      },
+    },
+    Action: commandAction,
+  }
+}
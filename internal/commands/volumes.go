@@ -0,0 +1,239 @@
+package commands
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VOLUME_MANIFEST_SUFFIX marks the file listing the volumes of a split
+// archive. It is written last so its presence means the set is complete.
+const VOLUME_MANIFEST_SUFFIX = ".volumes"
+
+type volumeInfo struct {
+  Name string `json:"name"`
+  Size int64 `json:"size"`
+  Sha1 string `json:"sha1"`
+}
+
+type volumeManifest struct {
+  Archive string `json:"archive"`
+  Volumes []volumeInfo `json:"volumes"`
+}
+
+// parseByteSize accepts sizes such as 4096, 500M or 2GiB
+func parseByteSize(value string) (int64, error) {
+  value = strings.TrimSpace(strings.ToUpper(value))
+  value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+  multiplier := int64(1)
+  suffixes := []string{"K", "M", "G", "T"}
+  for i, suffix := range suffixes {
+    if strings.HasSuffix(value, suffix) {
+      value = strings.TrimSuffix(value, suffix)
+      for j := 0; j <= i; j++ {
+        multiplier *= 1024
+      }
+      break
+    }
+  }
+
+  n, err := strconv.ParseInt(value, 10, 64)
+  if err != nil || n < 0 {
+    return 0, errors.New("Invalid size " + value)
+  }
+
+  return n * multiplier, nil
+}
+
+func volumeName(archive string, number int) string {
+  return fmt.Sprintf("%s.%03d", archive, number)
+}
+
+// volumeWriter splits everything written to it into numbered files of
+// at most size bytes
+type volumeWriter struct {
+  dir string
+  archive string
+  size int64
+  current *os.File
+  hash hash.Hash
+  written int64
+  volumes []volumeInfo
+}
+
+func newVolumeWriter(dir string, archive string, size int64) *volumeWriter {
+  return &volumeWriter{
+    dir: dir,
+    archive: archive,
+    size: size,
+  }
+}
+
+func (w *volumeWriter) next() error {
+  name := volumeName(w.archive, len(w.volumes) + 1)
+  file, err := os.Create(filepath.Join(w.dir, name))
+  if err != nil {
+    return err
+  }
+
+  w.current = file
+  w.hash = sha1.New()
+  w.written = 0
+  w.volumes = append(w.volumes, volumeInfo{
+    Name: name,
+  })
+
+  return nil
+}
+
+func (w *volumeWriter) finishCurrent() error {
+  if w.current == nil {
+    return nil
+  }
+
+  last := &w.volumes[len(w.volumes) - 1]
+  last.Size = w.written
+  last.Sha1 = hex.EncodeToString(w.hash.Sum(nil))
+
+  err := w.current.Close()
+  w.current = nil
+  return err
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+  total := 0
+  for len(p) > 0 {
+    if w.current == nil {
+      err := w.next()
+      if err != nil {
+        return total, err
+      }
+    }
+
+    n := int64(len(p))
+    if remaining := w.size - w.written; n > remaining {
+      n = remaining
+    }
+
+    written, err := io.MultiWriter(w.current, w.hash).Write(p[:n])
+    total += written
+    w.written += int64(written)
+    if err != nil {
+      return total, err
+    }
+
+    if w.written >= w.size {
+      err = w.finishCurrent()
+      if err != nil {
+        return total, err
+      }
+    }
+
+    p = p[n:]
+  }
+
+  return total, nil
+}
+
+// Close finishes the last volume and writes the manifest, returning the
+// paths of every file belonging to the archive
+func (w *volumeWriter) Close() ([]string, error) {
+  err := w.finishCurrent()
+  if err != nil {
+    return nil, err
+  }
+
+  manifest := volumeManifest{
+    Archive: w.archive,
+    Volumes: w.volumes,
+  }
+
+  data, err := json.Marshal(manifest)
+  if err != nil {
+    return nil, err
+  }
+
+  manifestName := w.archive + VOLUME_MANIFEST_SUFFIX
+  err = ioutil.WriteFile(filepath.Join(w.dir, manifestName), data, 0644)
+  if err != nil {
+    return nil, err
+  }
+
+  var paths []string
+  for _, volume := range w.volumes {
+    paths = append(paths, filepath.Join(w.dir, volume.Name))
+  }
+  paths = append(paths, filepath.Join(w.dir, manifestName))
+
+  return paths, nil
+}
+
+// volumeReader reassembles a split archive, checking every volume
+// against the manifest once it has been read in full
+type volumeReader struct {
+  locator *backupLocator
+  from string
+  volumes []volumeInfo
+  current io.ReadCloser
+  hash hash.Hash
+  read int64
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+  for {
+    if r.current == nil {
+      if len(r.volumes) == 0 {
+        return 0, io.EOF
+      }
+
+      current, err := r.locator.openFile(siblingBackup(r.from, r.volumes[0].Name))
+      if err != nil {
+        return 0, err
+      }
+
+      r.current = current
+      r.hash = sha1.New()
+      r.read = 0
+    }
+
+    n, err := r.current.Read(p)
+    r.hash.Write(p[:n])
+    r.read += int64(n)
+
+    if err == io.EOF {
+      volume := r.volumes[0]
+      r.current.Close()
+      r.current = nil
+      r.volumes = r.volumes[1:]
+
+      if r.read != volume.Size || hex.EncodeToString(r.hash.Sum(nil)) != volume.Sha1 {
+        return n, errors.New("Volume " + volume.Name + " does not match its checksum")
+      }
+
+      if n > 0 {
+        return n, nil
+      }
+      continue
+    }
+
+    return n, err
+  }
+}
+
+func (r *volumeReader) Close() error {
+  if r.current != nil {
+    return r.current.Close()
+  }
+
+  return nil
+}
@@ -0,0 +1,332 @@
+package commands
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jdollar/backup/internal/config"
+	"github.com/jdollar/backup/internal/logging"
+	"github.com/urfave/cli/v2"
+)
+
+const QUIET_PERIOD_FLAG = "quiet-period"
+const MIN_INTERVAL_FLAG = "min-interval"
+const MAX_DELAY_FLAG = "max-delay"
+
+// WATCH_TICK is how often pending changes are checked against the
+// quiet period and intervals
+const WATCH_TICK = time.Second
+
+type watchOptions struct {
+  QuietPeriod time.Duration
+  MinInterval time.Duration
+  MaxDelay time.Duration
+}
+
+// debouncer decides when a burst of filesystem changes has settled
+// enough to back up
+type debouncer struct {
+  opts watchOptions
+  firstChange time.Time
+  lastChange time.Time
+  lastBackup time.Time
+}
+
+func (d *debouncer) change(now time.Time) {
+  if d.firstChange.IsZero() {
+    d.firstChange = now
+  }
+  d.lastChange = now
+}
+
+func (d *debouncer) pending() bool {
+  return !d.firstChange.IsZero()
+}
+
+// due reports whether a backup should start. Changes have to be quiet
+// for the quiet period, unless they have been going on for longer than
+// the max delay, and backups are never closer than the min interval.
+func (d *debouncer) due(now time.Time) bool {
+  if !d.pending() {
+    return false
+  }
+
+  if !d.lastBackup.IsZero() && now.Sub(d.lastBackup) < d.opts.MinInterval {
+    return false
+  }
+
+  if now.Sub(d.lastChange) >= d.opts.QuietPeriod {
+    return true
+  }
+
+  return d.opts.MaxDelay > 0 && now.Sub(d.firstChange) >= d.opts.MaxDelay
+}
+
+func (d *debouncer) started(now time.Time) {
+  d.firstChange = time.Time{}
+  d.lastChange = time.Time{}
+  d.lastBackup = now
+}
+
+// watchTree adds path and, for directories, everything below it to the
+// watcher since fsnotify does not watch recursively
+func watchTree(watcher *fsnotify.Watcher, path string, ignore string) error {
+  return filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if isWithin(walkPath, ignore) {
+      return filepath.SkipDir
+    }
+
+    if info.IsDir() {
+      return watcher.Add(walkPath)
+    }
+
+    return nil
+  })
+}
+
+func isWithin(path string, dir string) bool {
+  absPath, err := filepath.Abs(path)
+  if err != nil {
+    return false
+  }
+
+  absDir, err := filepath.Abs(dir)
+  if err != nil {
+    return false
+  }
+
+  return absPath == absDir || strings.HasPrefix(absPath, absDir + string(filepath.Separator))
+}
+
+// watchFilter tells the events of the sources apart from those of
+// other files next to a file source, whose parent directory is watched
+type watchFilter struct {
+  trees []string
+  patterns []string
+}
+
+func (f *watchFilter) matches(name string) bool {
+  for _, tree := range f.trees {
+    if isWithin(name, tree) {
+      return true
+    }
+  }
+
+  absName, err := filepath.Abs(name)
+  if err != nil {
+    return false
+  }
+
+  // Matching the source pattern rather than the files found at startup
+  // picks up files created later that the next backup would include
+  for _, pattern := range f.patterns {
+    if ok, _ := filepath.Match(pattern, absName); ok {
+      return true
+    }
+  }
+
+  return false
+}
+
+// addTree makes the events below path match, for directories created
+// by a file source pattern
+func (f *watchFilter) addTree(path string) {
+  for _, tree := range f.trees {
+    if isWithin(path, tree) {
+      return
+    }
+  }
+
+  f.trees = append(f.trees, path)
+}
+
+func watchSources(watcher *fsnotify.Watcher, sources []string, ignore string) (*watchFilter, error) {
+  filter := &watchFilter{}
+
+  for _, source := range sources {
+    paths, err := filepath.Glob(source)
+    if err != nil {
+      return nil, err
+    }
+
+    if len(paths) == 0 {
+      return nil, errors.New("No files found to watch for " + source)
+    }
+
+    pattern, err := filepath.Abs(source)
+    if err != nil {
+      return nil, err
+    }
+    filter.patterns = append(filter.patterns, pattern)
+
+    for _, path := range paths {
+      info, err := os.Stat(path)
+      if err != nil {
+        return nil, err
+      }
+
+      if info.IsDir() {
+        err = watchTree(watcher, path, ignore)
+        filter.trees = append(filter.trees, path)
+      } else {
+        // Watch the parent so editors replacing the file are noticed
+        err = watcher.Add(filepath.Dir(path))
+      }
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  return filter, nil
+}
+
+func watchOptionsFromContext(c *cli.Context) (watchOptions, error) {
+  opts := watchOptions{
+    QuietPeriod: c.Duration(QUIET_PERIOD_FLAG),
+    MinInterval: c.Duration(MIN_INTERVAL_FLAG),
+    MaxDelay: c.Duration(MAX_DELAY_FLAG),
+  }
+
+  if opts.MaxDelay > 0 && opts.MaxDelay < opts.QuietPeriod {
+    return opts, errors.New("max-delay must be longer than the quiet period")
+  }
+
+  return opts, nil
+}
+
+func watchCommandAction(conf config.Configuration, c *cli.Context) error {
+  opts, err := backupOptionsFromContext(conf, c)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  wopts, err := watchOptionsFromContext(c)
+  if err != nil {
+    return withExitCode(EXIT_CONFIG, err)
+  }
+
+  watcher, err := fsnotify.NewWatcher()
+  if err != nil {
+    return err
+  }
+  defer watcher.Close()
+
+  filter, err := watchSources(watcher, opts.Sources, opts.OutputDirectory)
+  if err != nil {
+    return withExitCode(EXIT_SOURCE, err)
+  }
+
+  slog.Info(
+    "Watching for changes",
+    "quiet_period", wopts.QuietPeriod.String(),
+    "min_interval", wopts.MinInterval.String(),
+    "max_delay", wopts.MaxDelay.String(),
+  )
+
+  d := &debouncer{
+    opts: wopts,
+  }
+  done := make(chan error, 1)
+  running := false
+  ticker := time.NewTicker(WATCH_TICK)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case event, ok := <-watcher.Events:
+      if !ok {
+        return nil
+      }
+
+      if isWithin(event.Name, opts.OutputDirectory) || !filter.matches(event.Name) {
+        continue
+      }
+
+      // New directories have to be watched explicitly
+      if event.Op&fsnotify.Create != 0 {
+        if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+          err = watchTree(watcher, event.Name, opts.OutputDirectory)
+          if err != nil {
+            slog.Error("Error watching new directory", "file", event.Name, logging.Err(err))
+          }
+          filter.addTree(event.Name)
+        }
+      }
+
+      d.change(time.Now())
+    case err, ok := <-watcher.Errors:
+      if !ok {
+        return nil
+      }
+
+      // A dropped event means we may have missed changes, so treat it
+      // as one
+      slog.Warn("Watch error", logging.Err(err))
+      d.change(time.Now())
+    case <-c.Context.Done():
+      if running {
+        slog.Info("Stopping, waiting for the running backup")
+        <-done
+      }
+      return c.Context.Err()
+    case err := <-done:
+      running = false
+      if err != nil {
+        slog.Error("Backup failed", logging.Err(err))
+      }
+    case now := <-ticker.C:
+      if running || !d.due(now) {
+        continue
+      }
+
+      slog.Info("Changes settled, starting backup")
+      d.started(now)
+      running = true
+      go func() {
+        done <- runBackup(c.Context, conf, opts)
+      }()
+    }
+  }
+}
+
+func NewWatchCommand(conf config.Configuration) *cli.Command {
+  commandAction := func(c *cli.Context) error {
+    return watchCommandAction(conf, c)
+  }
+
+  flags := append(backupFlags(),
+    &cli.DurationFlag{
+      Name: QUIET_PERIOD_FLAG,
+      Usage: "How long the sources have to stop changing before a backup starts",
+      Value: 30 * time.Second,
+    },
+    &cli.DurationFlag{
+      Name: MIN_INTERVAL_FLAG,
+      Usage: "Minimum time between the start of two backups",
+      Value: 5 * time.Minute,
+    },
+    &cli.DurationFlag{
+      Name: MAX_DELAY_FLAG,
+      Usage: "Back up anyway once changes have been pending this long, 0 to wait for quiet forever",
+      Value: time.Hour,
+    },
+  )
+
+  return &cli.Command{
+    Name: "watch",
+    Usage: "Watch the given files and back them up to box once changes settle",
+    ArgsUsage: "<files...>",
+    Flags: flags,
+    Action: commandAction,
+  }
+}
@@ -2,7 +2,7 @@ package config
 
 import (
 	"bytes"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -19,13 +19,132 @@ type BoxConfiguration struct {
   SubjectId string `mapstructure:"subject_id" yaml:"subject_id"`
 }
 
+// RconConfiguration points at a Minecraft server's RCON port so world
+// saving can be paused while the world is archived
+type RconConfiguration struct {
+  Host string `mapstructure:"host" yaml:"host"`
+  Port int `mapstructure:"port" yaml:"port"`
+  Password string `mapstructure:"password" yaml:"password"`
+  SaveTimeout string `mapstructure:"save_timeout" yaml:"save_timeout"`
+}
+
+// HooksConfiguration lists shell commands run around each stage of a
+// backup. PreHookFailure is either "abort" or "continue".
+type HooksConfiguration struct {
+  Timeout string `mapstructure:"timeout" yaml:"timeout"`
+  PreHookFailure string `mapstructure:"pre_hook_failure" yaml:"pre_hook_failure"`
+  PreArchive []string `mapstructure:"pre_archive" yaml:"pre_archive"`
+  PostArchive []string `mapstructure:"post_archive" yaml:"post_archive"`
+  PreUpload []string `mapstructure:"pre_upload" yaml:"pre_upload"`
+  PostUpload []string `mapstructure:"post_upload" yaml:"post_upload"`
+  OnFailure []string `mapstructure:"on_failure" yaml:"on_failure"`
+}
+
+// NotifierConfiguration is somewhere notifications are sent. Type is
+// webhook, slack, discord, ntfy or email. Template and Subject are
+// text/template strings, the defaults are used when they are empty.
+type NotifierConfiguration struct {
+  Type string `mapstructure:"type" yaml:"type"`
+  Url string `mapstructure:"url" yaml:"url"`
+  Template string `mapstructure:"template" yaml:"template"`
+  Subject string `mapstructure:"subject" yaml:"subject"`
+  SmtpHost string `mapstructure:"smtp_host" yaml:"smtp_host"`
+  SmtpPort int `mapstructure:"smtp_port" yaml:"smtp_port"`
+  Username string `mapstructure:"username" yaml:"username"`
+  Password string `mapstructure:"password" yaml:"password"`
+  From string `mapstructure:"from" yaml:"from"`
+  To []string `mapstructure:"to" yaml:"to"`
+}
+
+// NotifyConfiguration lists the notifiers to send to for each outcome
+// of a backup. Queued means the archive was made but some uploads are
+// waiting to be retried.
+type NotifyConfiguration struct {
+  Success []string `mapstructure:"success" yaml:"success"`
+  Failure []string `mapstructure:"failure" yaml:"failure"`
+  Queued []string `mapstructure:"queued" yaml:"queued"`
+}
+
+// MetricsConfiguration sets where Prometheus metrics are exposed.
+// Listen is the address the daemon serves /metrics on, one-shot runs
+// write a file per job to TextfileDirectory for node_exporter.
+type MetricsConfiguration struct {
+  Listen string `mapstructure:"listen" yaml:"listen"`
+  TextfileDirectory string `mapstructure:"textfile_directory" yaml:"textfile_directory"`
+}
+
+// LockConfiguration decides what a run does while another run of the
+// same job holds its lock. Policy is wait, skip or fail. Timeout bounds
+// waiting and is unlimited when empty. Stale is how old a lock may get
+// before it is taken over when its process cannot be checked. Remote
+// also keeps a lock in every destination for runs on other hosts.
+type LockConfiguration struct {
+  Policy string `mapstructure:"policy" yaml:"policy"`
+  Timeout string `mapstructure:"timeout" yaml:"timeout"`
+  Stale string `mapstructure:"stale" yaml:"stale"`
+  Remote bool `mapstructure:"remote" yaml:"remote"`
+}
+
+// DestinationConfiguration is somewhere backups are uploaded to. Type
+// is "box", stored in Folder, "local", stored in the directory at Path
+// which may be a mounted NAS share, or "s3", stored under Prefix in
+// Bucket. Endpoint points s3 at a compatible service instead of AWS,
+// the keys fall back to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables. BackupLimit overrides the job's retention for
+// this destination.
+type DestinationConfiguration struct {
+  Type string `mapstructure:"type" yaml:"type"`
+  Folder string `mapstructure:"folder" yaml:"folder"`
+  Path string `mapstructure:"path" yaml:"path"`
+  Bucket string `mapstructure:"bucket" yaml:"bucket"`
+  Prefix string `mapstructure:"prefix" yaml:"prefix"`
+  Region string `mapstructure:"region" yaml:"region"`
+  Endpoint string `mapstructure:"endpoint" yaml:"endpoint"`
+  AccessKeyId string `mapstructure:"access_key_id" yaml:"access_key_id"`
+  SecretAccessKey string `mapstructure:"secret_access_key" yaml:"secret_access_key"`
+  BackupLimit int64 `mapstructure:"backup_limit" yaml:"backup_limit"`
+}
+
+// JobConfiguration describes a named backup. Schedule takes cron syntax
+// or "@every <duration>" and is only used by the daemon. Compression is
+// one of none, fast, default or best. Stream uploads the archive to
+// the destinations while it is written to the output directory.
+type JobConfiguration struct {
+  Sources []string `mapstructure:"sources" yaml:"sources"`
+  Excludes []string `mapstructure:"excludes" yaml:"excludes"`
+  OutputDirectory string `mapstructure:"output_directory" yaml:"output_directory"`
+  Compression string `mapstructure:"compression" yaml:"compression"`
+  Destinations []string `mapstructure:"destinations" yaml:"destinations"`
+  BackupLimit int64 `mapstructure:"backup_limit" yaml:"backup_limit"`
+  Incremental bool `mapstructure:"incremental" yaml:"incremental"`
+  FullEvery int `mapstructure:"full_every" yaml:"full_every"`
+  VolumeSize string `mapstructure:"volume_size" yaml:"volume_size"`
+  Stream bool `mapstructure:"stream" yaml:"stream"`
+  Notify *NotifyConfiguration `mapstructure:"notify" yaml:"notify"`
+  Lock *LockConfiguration `mapstructure:"lock" yaml:"lock"`
+  Schedule string `mapstructure:"schedule" yaml:"schedule"`
+  Jitter string `mapstructure:"jitter" yaml:"jitter"`
+}
+
 type Configuration struct {
   BackupLimit int64 `mapstructure:"backup_limit" yaml:"backup_limit"`
   Box BoxConfiguration `mapstructure:"box" yaml:"box"`
+  Rcon RconConfiguration `mapstructure:"rcon" yaml:"rcon"`
+  Hooks HooksConfiguration `mapstructure:"hooks" yaml:"hooks"`
+  Metrics MetricsConfiguration `mapstructure:"metrics" yaml:"metrics"`
+  Notifiers map[string]NotifierConfiguration `mapstructure:"notifiers" yaml:"notifiers"`
+  // Notify applies to backups that are not a job and jobs without
+  // their own notify settings
+  Notify NotifyConfiguration `mapstructure:"notify" yaml:"notify"`
+  // Lock applies to backups that are not a job and jobs without their
+  // own lock settings
+  Lock LockConfiguration `mapstructure:"lock" yaml:"lock"`
+  Destinations map[string]DestinationConfiguration `mapstructure:"destinations" yaml:"destinations"`
+  Jobs map[string]JobConfiguration `mapstructure:"jobs" yaml:"jobs"`
 }
 
 func initializeConfig(configDir string) error {
-  log.Println("Creating new config file")
+  slog.Info("Creating new config file", "directory", configDir)
   err := os.MkdirAll(configDir, os.ModePerm)
   if err != nil {
     return err
@@ -36,6 +155,14 @@ func initializeConfig(configDir string) error {
     Box: BoxConfiguration{
       BackupFolderName: "minecraftBackups",
     },
+    Rcon: RconConfiguration{
+      Port: 25575,
+      SaveTimeout: "5m",
+    },
+    Hooks: HooksConfiguration{
+      Timeout: "5m",
+      PreHookFailure: "abort",
+    },
   }
 
   // Convert empty config into bytes and upload it into
@@ -51,16 +178,25 @@ func initializeConfig(configDir string) error {
   return viper.SafeWriteConfig()
 }
 
+// Directory is where the config file and any state kept between runs
+// live
+func Directory() (string, error) {
+  homeDir, err := os.UserHomeDir()
+  if err != nil {
+    return "", err
+  }
+
+  return filepath.Join(homeDir, ".dropbox-backup"), nil
+}
+
 func NewConfiguration() (Configuration, error) {
   var config Configuration
 
-  homeDir, err := os.UserHomeDir()
+  configDir, err := Directory()
   if err != nil {
     return config, err
   }
 
-  configDir := filepath.Join(homeDir, ".dropbox-backup")
-
   viper.SetConfigName("config")
   viper.SetConfigType("yaml")
   viper.AddConfigPath(configDir)
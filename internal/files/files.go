@@ -1,10 +1,10 @@
 package files
 
 import (
-  "bufio"
+  "context"
   "crypto/sha1"
+  "fmt"
   "io"
-  "os"
 )
 
 type FilePart struct {
@@ -14,49 +14,94 @@ type FilePart struct {
   Digest []byte
 }
 
-func ChunkFile (file *os.File, partSize int64) ([]FilePart, error) {
+// ReadPart reads the next part of at most partSize bytes starting at
+// offset begin of the stream. Only the last part of a stream is short,
+// io.EOF is returned once nothing is left.
+func ReadPart(r io.Reader, begin int64, partSize int64) (FilePart, error) {
+  data := make([]byte, partSize)
+  n, err := io.ReadFull(r, data)
+  if n == 0 {
+    if err == nil || err == io.ErrUnexpectedEOF {
+      err = io.EOF
+    }
+    return FilePart{}, err
+  }
+
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return FilePart{}, err
+  }
+
+  data = data[:n]
+  h := sha1.New()
+  h.Write(data)
+
+  return FilePart{
+    Begin: begin,
+    End: begin + int64(n - 1),
+    Data: data,
+    Digest: h.Sum(nil),
+  }, nil
+}
+
+func ChunkFile (file io.Reader, partSize int64) ([]FilePart, error) {
   nBytes := int64(0)
-  r := bufio.NewReader(file)
-  buf := make([]byte, 0, partSize)
 
   var parts []FilePart
   for {
-    n, err := r.Read(buf[:cap(buf)])
-    buf = buf[:n]
-    if n == 0 {
-      if err == nil {
-        continue
-      }
-
-      if err == io.EOF {
-        break
-      }
-
+    part, err := ReadPart(file, nBytes, partSize)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
       return parts, err
     }
 
-    begin := nBytes
-    end := begin + int64(len(buf) - 1)
-    h := sha1.New()
-    h.Write(buf)
-    d := h.Sum(nil)
+    parts = append(parts, part)
+    nBytes += int64(len(part.Data))
+  }
 
-    data := make([]byte, len(buf))
-    copy(data, buf)
+  return parts, nil
+}
 
-    part := FilePart{
-      Begin: begin,
-      End: end,
-      Data: data,
-      Digest: d,
-    }
-    parts = append(parts, part)
+type contextReader struct {
+  ctx context.Context
+  r io.Reader
+}
 
-    nBytes += int64(len(buf))
-    if err != nil && err != io.EOF {
-      return parts, err
+// NewContextReader returns a reader that fails with the context's error
+// once ctx is cancelled, so long copies stop partway through
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+  return contextReader{
+    ctx: ctx,
+    r: r,
+  }
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+  if err := c.ctx.Err(); err != nil {
+    return 0, err
+  }
+
+  return c.r.Read(p)
+}
+
+// FormatBytes renders a byte count, or a difference of one, with
+// binary units
+func FormatBytes(n int64) string {
+  const unit = 1024
+  if n < unit && n > -unit {
+    return fmt.Sprintf("%d B", n)
+  }
+
+  value := float64(n)
+  suffix := ""
+  for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+    value /= unit
+    suffix = s
+    if value < unit && value > -unit {
+      break
     }
   }
 
-  return parts, nil
+  return fmt.Sprintf("%.1f %s", value, suffix)
 }
@@ -0,0 +1,260 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DEFAULT_JOB is where runs that are not part of a named job are kept
+const DEFAULT_JOB = "default"
+
+// RUNS_PER_JOB is how many runs are kept for each job, older ones are
+// dropped as new ones are added
+const RUNS_PER_JOB = 1000
+
+const OPEN_TIMEOUT = 10 * time.Second
+
+var runsBucket = []byte("runs")
+var lastSuccessBucket = []byte("last_success")
+
+type Destination struct {
+  Name string `json:"name"`
+  FileIds []string `json:"file_ids"`
+  Error string `json:"error,omitempty"`
+}
+
+// Run is one backup run
+type Run struct {
+  Id uint64 `json:"id"`
+  Job string `json:"job"`
+  Started time.Time `json:"started"`
+  Finished time.Time `json:"finished"`
+  Sources []string `json:"sources"`
+  Archive string `json:"archive"`
+  ArchiveSize int64 `json:"archive_size"`
+  Sha1 string `json:"sha1"`
+  Destinations []Destination `json:"destinations"`
+  Outcome string `json:"outcome"`
+  Error string `json:"error,omitempty"`
+}
+
+// Store keeps the run history in a bbolt database. The database is only
+// held open while it is used so a status query can read it while the
+// daemon runs.
+type Store struct {
+  path string
+}
+
+// mu serializes access from this process, bbolt's file lock would make
+// a second open from the same process wait for the first
+var mu sync.Mutex
+
+func Open(path string) *Store {
+  return &Store{
+    path: path,
+  }
+}
+
+func (s *Store) update(fn func(*bolt.Tx) error) error {
+  mu.Lock()
+  defer mu.Unlock()
+
+  db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: OPEN_TIMEOUT})
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+
+  return db.Update(fn)
+}
+
+// view opens the database read only, so status and history work without
+// write access. A database that does not exist yet has no runs.
+func (s *Store) view(fn func(*bolt.Tx) error) error {
+  mu.Lock()
+  defer mu.Unlock()
+
+  if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+    return fn(nil)
+  }
+
+  db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: OPEN_TIMEOUT, ReadOnly: true})
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+
+  return db.View(fn)
+}
+
+// bucket returns a top level bucket, nil when it or the transaction
+// does not exist
+func bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+  if tx == nil {
+    return nil
+  }
+
+  return tx.Bucket(name)
+}
+
+func runKey(id uint64) []byte {
+  key := make([]byte, 8)
+  binary.BigEndian.PutUint64(key, id)
+  return key
+}
+
+func jobName(job string) string {
+  if job == "" {
+    return DEFAULT_JOB
+  }
+  return job
+}
+
+// Add records a run and returns it with its id set
+func (s *Store) Add(run Run) (Run, error) {
+  run.Job = jobName(run.Job)
+
+  err := s.update(func(tx *bolt.Tx) error {
+    runs, err := tx.CreateBucketIfNotExists(runsBucket)
+    if err != nil {
+      return err
+    }
+
+    jobRuns, err := runs.CreateBucketIfNotExists([]byte(run.Job))
+    if err != nil {
+      return err
+    }
+
+    run.Id, err = jobRuns.NextSequence()
+    if err != nil {
+      return err
+    }
+
+    data, err := json.Marshal(run)
+    if err != nil {
+      return err
+    }
+
+    err = jobRuns.Put(runKey(run.Id), data)
+    if err != nil {
+      return err
+    }
+
+    lastSuccess, err := tx.CreateBucketIfNotExists(lastSuccessBucket)
+    if err != nil {
+      return err
+    }
+
+    if run.Outcome == "success" || run.Outcome == "skipped" {
+      err = lastSuccess.Put([]byte(run.Job), data)
+      if err != nil {
+        return err
+      }
+    }
+
+    // Stats only counts committed pages, so the runs are counted here.
+    // Keys are ordered, so the first ones are the oldest runs.
+    count := 0
+    c := jobRuns.Cursor()
+    for key, _ := c.First(); key != nil; key, _ = c.Next() {
+      count++
+    }
+
+    var old [][]byte
+    for key, _ := c.First(); key != nil && count - len(old) > RUNS_PER_JOB; key, _ = c.Next() {
+      old = append(old, append([]byte{}, key...))
+    }
+
+    for _, key := range old {
+      err = jobRuns.Delete(key)
+      if err != nil {
+        return err
+      }
+    }
+
+    return nil
+  })
+
+  return run, err
+}
+
+// Jobs returns the names of the jobs with recorded runs
+func (s *Store) Jobs() ([]string, error) {
+  var jobs []string
+  err := s.view(func(tx *bolt.Tx) error {
+    runs := bucket(tx, runsBucket)
+    if runs == nil {
+      return nil
+    }
+
+    return runs.ForEachBucket(func(name []byte) error {
+      jobs = append(jobs, string(name))
+      return nil
+    })
+  })
+
+  sort.Strings(jobs)
+  return jobs, err
+}
+
+// Runs returns up to limit of the most recent runs of a job, newest
+// first
+func (s *Store) Runs(job string, limit int) ([]Run, error) {
+  var result []Run
+  err := s.view(func(tx *bolt.Tx) error {
+    runs := bucket(tx, runsBucket)
+    if runs == nil {
+      return nil
+    }
+
+    jobRuns := runs.Bucket([]byte(jobName(job)))
+    if jobRuns == nil {
+      return nil
+    }
+
+    c := jobRuns.Cursor()
+    for key, value := c.Last(); key != nil && (limit <= 0 || len(result) < limit); key, value = c.Prev() {
+      var run Run
+      err := json.Unmarshal(value, &run)
+      if err != nil {
+        return err
+      }
+      result = append(result, run)
+    }
+
+    return nil
+  })
+
+  return result, err
+}
+
+var ErrNoSuccess = errors.New("no successful run recorded")
+
+// LastSuccess returns the most recent successful run of a job, which
+// includes runs skipped because nothing changed. The latest success is
+// kept separately so it survives history pruning.
+func (s *Store) LastSuccess(job string) (Run, error) {
+  var run Run
+  err := s.view(func(tx *bolt.Tx) error {
+    lastSuccess := bucket(tx, lastSuccessBucket)
+    if lastSuccess == nil {
+      return ErrNoSuccess
+    }
+
+    data := lastSuccess.Get([]byte(jobName(job)))
+    if data == nil {
+      return ErrNoSuccess
+    }
+
+    return json.Unmarshal(data, &run)
+  })
+
+  return run, err
+}
@@ -0,0 +1,117 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stages a hook can be attached to
+const PRE_ARCHIVE = "pre_archive"
+const POST_ARCHIVE = "post_archive"
+const PRE_UPLOAD = "pre_upload"
+const POST_UPLOAD = "post_upload"
+const ON_FAILURE = "on_failure"
+
+const DEFAULT_TIMEOUT = 5 * time.Minute
+
+type Opts struct {
+  Timeout time.Duration
+  // AbortOnPreHookFailure stops the backup when a pre_ hook fails,
+  // otherwise the failure is only logged
+  AbortOnPreHookFailure bool
+  Commands map[string][]string
+}
+
+// Env describes the backup to the hook commands
+type Env struct {
+  Job string
+  ArchiveName string
+  // ArchivePath is the volume manifest for an archive split into volumes
+  ArchivePath string
+  ArchiveSize int64
+  DestinationFileIds []string
+  Status string
+  Error string
+}
+
+func (e Env) environ(stage string) []string {
+  env := os.Environ()
+  env = append(env,
+    "BACKUP_HOOK=" + stage,
+    "BACKUP_JOB=" + e.Job,
+    "BACKUP_ARCHIVE_NAME=" + e.ArchiveName,
+    "BACKUP_ARCHIVE_PATH=" + e.ArchivePath,
+    "BACKUP_ARCHIVE_SIZE=" + strconv.FormatInt(e.ArchiveSize, 10),
+    "BACKUP_DESTINATION_FILE_ID=" + strings.Join(e.DestinationFileIds, ","),
+    "BACKUP_STATUS=" + e.Status,
+    "BACKUP_ERROR=" + e.Error,
+  )
+
+  return env
+}
+
+type Runner struct {
+  opts Opts
+}
+
+func NewRunner(opts Opts) Runner {
+  if opts.Timeout <= 0 {
+    opts.Timeout = DEFAULT_TIMEOUT
+  }
+
+  return Runner{
+    opts: opts,
+  }
+}
+
+func (r Runner) runCommand(ctx context.Context, stage string, command string, env Env) error {
+  ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+  defer cancel()
+
+  slog.Info("Running hook", "stage", stage, "job", env.Job, "command", command)
+  cmd := exec.CommandContext(ctx, "sh", "-c", command)
+  killProcessGroup(cmd)
+  cmd.Env = env.environ(stage)
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+
+  err := cmd.Run()
+  if ctx.Err() == context.DeadlineExceeded {
+    return fmt.Errorf("%s hook %q timed out after %s", stage, command, r.opts.Timeout)
+  }
+  if ctx.Err() == context.Canceled {
+    return fmt.Errorf("%s hook %q was interrupted: %w", stage, command, ctx.Err())
+  }
+  if err != nil {
+    return fmt.Errorf("%s hook %q failed: %w", stage, command, err)
+  }
+
+  return nil
+}
+
+// Run executes every command configured for stage in order. Failures of
+// pre_ hooks are returned when the runner is set to abort on them, any
+// other failure is logged so it cannot mask the outcome of the backup.
+// Cancelling ctx stops the running command.
+func (r Runner) Run(ctx context.Context, stage string, env Env) error {
+  for _, command := range r.opts.Commands[stage] {
+    err := r.runCommand(ctx, stage, command, env)
+    if err == nil {
+      continue
+    }
+
+    if strings.HasPrefix(stage, "pre_") && r.opts.AbortOnPreHookFailure {
+      return err
+    }
+
+    slog.Error("Hook failed", "stage", stage, "job", env.Job, "error", err.Error())
+  }
+
+  return nil
+}
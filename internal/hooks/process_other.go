@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package hooks
+
+import "os/exec"
+
+// Process groups are not available on this platform, cancelling a hook
+// only kills the shell
+func killProcessGroup(cmd *exec.Cmd) {
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package hooks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs the hook in its own process group and kills the
+// whole group when it is cancelled, so children of the shell stop too
+func killProcessGroup(cmd *exec.Cmd) {
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+  cmd.Cancel = func() error {
+    return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+}
@@ -0,0 +1,73 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// errWouldBlock is returned by tryLockFile while another process holds
+// the lock
+var errWouldBlock = errors.New("file is locked by another process")
+
+// Flock is an exclusive lock on an open file. The operating system
+// releases it when the process exits, however it exits.
+type Flock struct {
+  file *os.File
+}
+
+func openLockFile(path string) (*os.File, error) {
+  err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+  if err != nil {
+    return nil, err
+  }
+
+  return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// LockExclusive waits until it holds the lock on path, for guarding
+// short read-modify-write sections of files other processes also update
+func LockExclusive(path string) (*Flock, error) {
+  file, err := openLockFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  err = lockFile(file, true)
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+
+  return &Flock{
+    file: file,
+  }, nil
+}
+
+// TryLockExclusive takes the lock on path if no other process holds it,
+// errWouldBlock is returned otherwise
+func TryLockExclusive(path string) (*Flock, error) {
+  file, err := openLockFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  err = lockFile(file, false)
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+
+  return &Flock{
+    file: file,
+  }, nil
+}
+
+func (f *Flock) Unlock() error {
+  err := unlockFile(f.file)
+  if closeErr := f.file.Close(); err == nil {
+    err = closeErr
+  }
+
+  return err
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(file *os.File, block bool) error {
+  return errors.ErrUnsupported
+}
+
+func unlockFile(file *os.File) error {
+  return nil
+}
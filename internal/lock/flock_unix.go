@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func lockFile(file *os.File, block bool) error {
+  how := syscall.LOCK_EX
+  if !block {
+    how |= syscall.LOCK_NB
+  }
+
+  for {
+    err := syscall.Flock(int(file.Fd()), how)
+    if errors.Is(err, syscall.EINTR) {
+      continue
+    }
+    if errors.Is(err, syscall.EWOULDBLOCK) {
+      return errWouldBlock
+    }
+    return err
+  }
+}
+
+func unlockFile(file *os.File) error {
+  return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
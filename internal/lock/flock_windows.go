@@ -0,0 +1,27 @@
+//go:build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockFile(file *os.File, block bool) error {
+  flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK)
+  if !block {
+    flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+  }
+
+  err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+  if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+    return errWouldBlock
+  }
+  return err
+}
+
+func unlockFile(file *os.File) error {
+  return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
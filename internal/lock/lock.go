@@ -0,0 +1,306 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jdollar/backup/internal/storage"
+)
+
+var ErrLocked = errors.New("Lock is held by another run")
+
+// Owner identifies the run holding a lock
+type Owner struct {
+  Id string `json:"id"`
+  Pid int `json:"pid"`
+  Host string `json:"host"`
+  Started time.Time `json:"started"`
+}
+
+func newOwner() (Owner, error) {
+  id := make([]byte, 8)
+  _, err := rand.Read(id)
+  if err != nil {
+    return Owner{}, err
+  }
+
+  host, _ := os.Hostname()
+  return Owner{
+    Id: hex.EncodeToString(id),
+    Pid: os.Getpid(),
+    Host: host,
+    Started: time.Now().UTC(),
+  }, nil
+}
+
+// stale reports whether the run holding the lock is gone. On the same
+// host that is known from its PID, though a PID can be reused after a
+// reboot, so any lock older than maxAge is stale as well.
+func (o Owner) stale(maxAge time.Duration) bool {
+  if maxAge > 0 && time.Since(o.Started) > maxAge {
+    return true
+  }
+
+  host, _ := os.Hostname()
+  return o.Host == host && o.Pid > 0 && canCheckProcesses && !processAlive(o.Pid)
+}
+
+func lockedError(owner Owner) error {
+  return fmt.Errorf("%w, pid %d on %s since %s", ErrLocked, owner.Pid, owner.Host, owner.Started.Local().Format(time.RFC3339))
+}
+
+// File is a lock held through a file on the local disk. Where the
+// platform has file locks the operating system releases it when the run
+// exits however it exits, the file only names the owner and is left in
+// place.
+type File struct {
+  path string
+  owner Owner
+  flock *Flock
+}
+
+func readFileOwner(path string) (Owner, error) {
+  var owner Owner
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    return owner, err
+  }
+
+  err = json.Unmarshal(data, &owner)
+  return owner, err
+}
+
+// AcquireFile takes the lock at path. ErrLocked is returned while
+// another run holds it.
+func AcquireFile(path string, maxAge time.Duration) (*File, error) {
+  owner, err := newOwner()
+  if err != nil {
+    return nil, err
+  }
+
+  data, err := json.Marshal(owner)
+  if err != nil {
+    return nil, err
+  }
+
+  flock, err := TryLockExclusive(path)
+  if errors.Is(err, errors.ErrUnsupported) {
+    return acquireLinkedFile(path, owner, data, maxAge)
+  }
+  if errors.Is(err, errWouldBlock) {
+    // The owner is written right after locking, it may not be there yet
+    existing, readErr := readFileOwner(path)
+    if readErr != nil {
+      return nil, ErrLocked
+    }
+    return nil, lockedError(existing)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  err = flock.file.Truncate(0)
+  if err == nil {
+    _, err = flock.file.WriteAt(data, 0)
+  }
+  if err != nil {
+    flock.Unlock()
+    return nil, err
+  }
+
+  return &File{
+    path: path,
+    owner: owner,
+    flock: flock,
+  }, nil
+}
+
+// acquireLinkedFile takes the lock on platforms without file locks by
+// linking a file naming the owner into place, which fails while the
+// lock exists. Two runs may both remove a stale lock and link their
+// own, so the owner is read back afterwards.
+func acquireLinkedFile(path string, owner Owner, data []byte, maxAge time.Duration) (*File, error) {
+  err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+  if err != nil {
+    return nil, err
+  }
+
+  // The owner is written to a temporary file first so a lock is never
+  // only partly written
+  tmp, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".*")
+  if err != nil {
+    return nil, err
+  }
+  defer os.Remove(tmp.Name())
+
+  _, err = tmp.Write(data)
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  for attempt := 0; attempt < 2; attempt++ {
+    err = os.Link(tmp.Name(), path)
+    if err == nil {
+      current, err := readFileOwner(path)
+      if err != nil {
+        return nil, err
+      }
+      if current.Id != owner.Id {
+        return nil, lockedError(current)
+      }
+
+      return &File{
+        path: path,
+        owner: owner,
+      }, nil
+    }
+    if !errors.Is(err, os.ErrExist) {
+      return nil, err
+    }
+
+    existing, err := readFileOwner(path)
+    if errors.Is(err, os.ErrNotExist) {
+      continue
+    }
+    if err != nil {
+      return nil, err
+    }
+
+    if !existing.stale(maxAge) {
+      return nil, lockedError(existing)
+    }
+
+    slog.Warn("Removing stale lock", "lock", path, "pid", existing.Pid, "host", existing.Host, "started", existing.Started)
+    err = os.Remove(path)
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+      return nil, err
+    }
+  }
+
+  return nil, ErrLocked
+}
+
+// Release gives up the lock. A linked lock file is removed unless
+// another run has taken it over.
+func (f *File) Release() error {
+  if f.flock != nil {
+    return f.flock.Unlock()
+  }
+
+  existing, err := readFileOwner(f.path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  if existing.Id != f.owner.Id {
+    return nil
+  }
+
+  return os.Remove(f.path)
+}
+
+// Remote is a lock held through an object in a storage backend, which
+// runs on other hosts sharing the destination can see. Backends cannot
+// create an object only if it is missing, so two runs starting at the
+// same moment may both get the lock.
+type Remote struct {
+  backend storage.Backend
+  name string
+  owner Owner
+}
+
+func readRemoteOwner(ctx context.Context, backend storage.Backend, name string) (Owner, error) {
+  var owner Owner
+  r, err := backend.Open(ctx, name)
+  if err != nil {
+    return owner, err
+  }
+  defer r.Close()
+
+  err = json.NewDecoder(r).Decode(&owner)
+  return owner, err
+}
+
+// AcquireRemote takes the lock stored as name in backend, replacing it
+// when it is older than maxAge or its run is gone. ErrLocked is
+// returned while another run holds it.
+func AcquireRemote(ctx context.Context, backend storage.Backend, name string, maxAge time.Duration) (*Remote, error) {
+  existing, err := readRemoteOwner(ctx, backend, name)
+  switch {
+  case errors.Is(err, storage.ErrNotFound):
+  case err != nil:
+    return nil, err
+  case !existing.stale(maxAge):
+    return nil, lockedError(existing)
+  default:
+    slog.Warn("Removing stale remote lock", "lock", name, "pid", existing.Pid, "host", existing.Host, "started", existing.Started)
+    err = backend.Remove(ctx, name)
+    if err != nil && !errors.Is(err, storage.ErrNotFound) {
+      return nil, err
+    }
+  }
+
+  owner, err := newOwner()
+  if err != nil {
+    return nil, err
+  }
+
+  data, err := json.Marshal(owner)
+  if err != nil {
+    return nil, err
+  }
+
+  _, err = backend.Save(ctx, name, bytes.NewReader(data), int64(len(data)))
+  if err != nil && !errors.Is(err, storage.ErrExists) {
+    return nil, err
+  }
+
+  // Read the lock back so when two runs wrote it only the one whose
+  // write stuck goes ahead
+  current, err := readRemoteOwner(ctx, backend, name)
+  if err != nil {
+    return nil, err
+  }
+  if current.Id != owner.Id {
+    return nil, lockedError(current)
+  }
+
+  return &Remote{
+    backend: backend,
+    name: name,
+    owner: owner,
+  }, nil
+}
+
+// Release removes the lock object unless another run has taken it over
+func (r *Remote) Release(ctx context.Context) error {
+  existing, err := readRemoteOwner(ctx, r.backend, r.name)
+  if errors.Is(err, storage.ErrNotFound) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  if existing.Id != r.owner.Id {
+    return nil
+  }
+
+  return r.backend.Remove(ctx, r.name)
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package lock
+
+// Processes cannot be checked on this platform so local locks go stale
+// by age like remote ones
+const canCheckProcesses = false
+
+func processAlive(pid int) bool {
+  return true
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package lock
+
+import (
+	"errors"
+	"syscall"
+)
+
+const canCheckProcesses = true
+
+// processAlive sends signal 0, which only checks the process exists. A
+// process of another user still exists when the signal is refused.
+func processAlive(pid int) bool {
+  err := syscall.Kill(pid, 0)
+  return err == nil || errors.Is(err, syscall.EPERM)
+}
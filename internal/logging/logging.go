@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/jdollar/backup/internal/box"
+	"github.com/jdollar/backup/internal/s3"
+)
+
+const FORMAT_TEXT = "text"
+const FORMAT_JSON = "json"
+
+// Setup makes a logger writing to w in the given format the default
+// for slog and the standard log package
+func Setup(w io.Writer, format string, level string) error {
+  var logLevel slog.Level
+  err := logLevel.UnmarshalText([]byte(level))
+  if err != nil {
+    return errors.New("Invalid log level " + level + ", expected debug, info, warn or error")
+  }
+
+  opts := &slog.HandlerOptions{
+    Level: logLevel,
+  }
+
+  var handler slog.Handler
+  switch strings.ToLower(format) {
+  case FORMAT_TEXT:
+    handler = slog.NewTextHandler(w, opts)
+  case FORMAT_JSON:
+    handler = slog.NewJSONHandler(w, opts)
+  default:
+    return errors.New("Invalid log format " + format + ", expected text or json")
+  }
+
+  slog.SetDefault(slog.New(handler))
+  return nil
+}
+
+// Err is the attribute errors are logged under. Failed box and s3
+// requests also log the status and request id, which support asks for.
+func Err(err error) slog.Attr {
+  attr := slog.String("error", err.Error())
+
+  var boxErr *box.ClientError
+  if errors.As(err, &boxErr) {
+    return requestAttrs(attr, boxErr.Status, boxErr.RequestId)
+  }
+
+  var s3Err *s3.ClientError
+  if errors.As(err, &s3Err) {
+    return requestAttrs(attr, s3Err.Status, s3Err.RequestId)
+  }
+
+  return attr
+}
+
+// requestAttrs inlines the request details next to the error, a group
+// without a key is flattened by the handlers
+func requestAttrs(attr slog.Attr, status int, requestId string) slog.Attr {
+  attrs := []slog.Attr{attr, slog.Int("status", status)}
+  if requestId != "" {
+    attrs = append(attrs, slog.String("request_id", requestId))
+  }
+
+  return slog.Attr{Key: "", Value: slog.GroupValue(attrs...)}
+}
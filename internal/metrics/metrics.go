@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const GAUGE = "gauge"
+const COUNTER = "counter"
+
+type series struct {
+  labels string
+  value float64
+}
+
+type family struct {
+  name string
+  kind string
+  help string
+  series map[string]*series
+}
+
+// Registry holds metric values and writes them in the Prometheus text
+// exposition format
+type Registry struct {
+  mu sync.Mutex
+  families map[string]*family
+}
+
+func NewRegistry() *Registry {
+  return &Registry{
+    families: map[string]*family{},
+  }
+}
+
+// Default is the registry the backup commands record into
+var Default = NewRegistry()
+
+// Describe registers a metric. Values for metrics that were never
+// described are dropped.
+func (r *Registry) Describe(name string, kind string, help string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if _, ok := r.families[name]; ok {
+    return
+  }
+
+  r.families[name] = &family{
+    name: name,
+    kind: kind,
+    help: help,
+    series: map[string]*series{},
+  }
+}
+
+func escapeLabelValue(value string) string {
+  value = strings.ReplaceAll(value, `\`, `\\`)
+  value = strings.ReplaceAll(value, "\n", `\n`)
+  return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+// formatLabels turns name, value pairs into the label block of a
+// sample, leaving out empty values
+func formatLabels(labels []string) string {
+  var parts []string
+  for i := 0; i+1 < len(labels); i += 2 {
+    if labels[i+1] == "" {
+      continue
+    }
+    parts = append(parts, labels[i] + `="` + escapeLabelValue(labels[i+1]) + `"`)
+  }
+
+  if len(parts) == 0 {
+    return ""
+  }
+
+  return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *Registry) update(name string, labels []string, fn func(*series)) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  f, ok := r.families[name]
+  if !ok {
+    return
+  }
+
+  key := formatLabels(labels)
+  s, ok := f.series[key]
+  if !ok {
+    s = &series{
+      labels: key,
+    }
+    f.series[key] = s
+  }
+
+  fn(s)
+}
+
+// Set sets a gauge. Labels are given as name, value pairs.
+func (r *Registry) Set(name string, value float64, labels ...string) {
+  r.update(name, labels, func(s *series) {
+    s.value = value
+  })
+}
+
+// Add increases a counter. Labels are given as name, value pairs.
+func (r *Registry) Add(name string, value float64, labels ...string) {
+  r.update(name, labels, func(s *series) {
+    s.value += value
+  })
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  var names []string
+  for name, f := range r.families {
+    if len(f.series) > 0 {
+      names = append(names, name)
+    }
+  }
+  sort.Strings(names)
+
+  var buf bytes.Buffer
+  for _, name := range names {
+    f := r.families[name]
+    fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, f.help)
+    fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.kind)
+
+    var keys []string
+    for key := range f.series {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+      value := strconv.FormatFloat(f.series[key].value, 'f', -1, 64)
+      fmt.Fprintf(&buf, "%s%s %s\n", f.name, key, value)
+    }
+  }
+
+  return buf.WriteTo(w)
+}
+
+// WriteTextfile writes the metrics for the node_exporter textfile
+// collector. The file is renamed into place so the collector never
+// reads a partial file.
+func (r *Registry) WriteTextfile(path string) error {
+  tmp, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".*")
+  if err != nil {
+    return err
+  }
+
+  _, err = r.WriteTo(tmp)
+  if err == nil {
+    err = tmp.Chmod(0644)
+  }
+  if err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+
+  err = tmp.Close()
+  if err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+
+  return os.Rename(tmp.Name(), path)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  r.WriteTo(w)
+}
@@ -0,0 +1,231 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jdollar/backup/internal/files"
+)
+
+// Outcomes a notification can be sent for
+const SUCCESS = "success"
+const FAILURE = "failure"
+const QUEUED = "queued"
+
+// Notifier types
+const WEBHOOK = "webhook"
+const SLACK = "slack"
+const DISCORD = "discord"
+const NTFY = "ntfy"
+const EMAIL = "email"
+
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+const DEFAULT_MESSAGE = `Backup {{with .Job}}{{.}}{{else}}run{{end}} on {{.Host}}: {{.Outcome}}
+{{- if .Archive}}
+Archive {{.Archive}} ({{bytes .ArchiveSize}}) in {{.Duration}}
+{{- end}}
+{{- range .Destinations}}
+{{.Name}}: {{if .Error}}failed: {{.Error}}{{else}}{{join .Links " "}}{{end}}
+{{- end}}
+{{- if .Error}}
+Error: {{.Error}}
+{{- end}}`
+
+const DEFAULT_SUBJECT = `[backup] {{with .Job}}{{.}}{{else}}run{{end}} on {{.Host}}: {{.Outcome}}`
+
+// Destination is how the upload to one destination went
+type Destination struct {
+  Name string `json:"name"`
+  Links []string `json:"links"`
+  Error string `json:"error,omitempty"`
+}
+
+// Event is a finished backup run that notifications describe
+type Event struct {
+  Job string `json:"job"`
+  Host string `json:"host"`
+  Outcome string `json:"outcome"`
+  Time time.Time `json:"time"`
+  Archive string `json:"archive"`
+  ArchiveSize int64 `json:"archive_size"`
+  Duration time.Duration `json:"-"`
+  Destinations []Destination `json:"destinations"`
+  Error string `json:"error,omitempty"`
+}
+
+type Opts struct {
+  Type string
+  Url string
+  // Template is the message body, Subject the email subject and ntfy
+  // title. Both are text/template strings over an Event.
+  Template string
+  Subject string
+  SmtpHost string
+  SmtpPort int
+  Username string
+  Password string
+  From string
+  To []string
+}
+
+type Notifier struct {
+  opts Opts
+  message *template.Template
+  subject *template.Template
+  client *http.Client
+}
+
+var funcs = template.FuncMap{
+  "bytes": files.FormatBytes,
+  "join": strings.Join,
+}
+
+func New(opts Opts) (*Notifier, error) {
+  switch opts.Type {
+  case WEBHOOK, SLACK, DISCORD, NTFY:
+    if opts.Url == "" {
+      return nil, errors.New("Missing url for " + opts.Type + " notifier")
+    }
+  case EMAIL:
+    if opts.SmtpHost == "" || opts.From == "" || len(opts.To) == 0 {
+      return nil, errors.New("Email notifier needs smtp_host, from and to")
+    }
+    if opts.SmtpPort == 0 {
+      opts.SmtpPort = 587
+    }
+  default:
+    return nil, errors.New("Invalid notifier type " + opts.Type + ", expected webhook, slack, discord, ntfy or email")
+  }
+
+  if opts.Template == "" {
+    opts.Template = DEFAULT_MESSAGE
+  }
+  if opts.Subject == "" {
+    opts.Subject = DEFAULT_SUBJECT
+  }
+
+  message, err := template.New("message").Funcs(funcs).Parse(opts.Template)
+  if err != nil {
+    return nil, err
+  }
+
+  subject, err := template.New("subject").Funcs(funcs).Parse(opts.Subject)
+  if err != nil {
+    return nil, err
+  }
+
+  return &Notifier{
+    opts: opts,
+    message: message,
+    subject: subject,
+    client: &http.Client{
+      Timeout: DEFAULT_TIMEOUT,
+    },
+  }, nil
+}
+
+func render(t *template.Template, event Event) (string, error) {
+  var buf bytes.Buffer
+  err := t.Execute(&buf, event)
+  return buf.String(), err
+}
+
+func (n *Notifier) post(body []byte, contentType string, headers map[string]string) error {
+  req, err := http.NewRequest(http.MethodPost, n.opts.Url, bytes.NewReader(body))
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set("Content-Type", contentType)
+  for name, value := range headers {
+    req.Header.Set(name, value)
+  }
+
+  resp, err := n.client.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return errors.New(n.opts.Type + " notification rejected with status " + resp.Status)
+  }
+
+  return nil
+}
+
+func (n *Notifier) postJSON(payload interface{}) error {
+  body, err := json.Marshal(payload)
+  if err != nil {
+    return err
+  }
+
+  return n.post(body, "application/json", nil)
+}
+
+func (n *Notifier) sendEmail(subject string, message string) error {
+  var msg bytes.Buffer
+  fmt.Fprintf(&msg, "From: %s\r\n", n.opts.From)
+  fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.opts.To, ", "))
+  fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+  fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+  msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+  msg.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+
+  var auth smtp.Auth
+  if n.opts.Username != "" {
+    auth = smtp.PlainAuth("", n.opts.Username, n.opts.Password, n.opts.SmtpHost)
+  }
+
+  address := n.opts.SmtpHost + ":" + strconv.Itoa(n.opts.SmtpPort)
+  return smtp.SendMail(address, auth, n.opts.From, n.opts.To, msg.Bytes())
+}
+
+// Notify sends the event in the notifier's format
+func (n *Notifier) Notify(event Event) error {
+  message, err := render(n.message, event)
+  if err != nil {
+    return err
+  }
+
+  subject, err := render(n.subject, event)
+  if err != nil {
+    return err
+  }
+
+  switch n.opts.Type {
+  case WEBHOOK:
+    return n.postJSON(struct {
+      Event
+      Duration float64 `json:"duration_seconds"`
+      Message string `json:"message"`
+    }{event, event.Duration.Seconds(), message})
+  case SLACK:
+    return n.postJSON(map[string]string{"text": message})
+  case DISCORD:
+    return n.postJSON(map[string]string{"content": message})
+  case NTFY:
+    headers := map[string]string{
+      "Title": subject,
+      "Tags": "floppy_disk",
+    }
+    if event.Outcome == FAILURE {
+      headers["Priority"] = "high"
+      headers["Tags"] = "warning"
+    }
+    return n.post([]byte(message), "text/plain; charset=utf-8", headers)
+  case EMAIL:
+    return n.sendEmail(subject, message)
+  }
+
+  return nil
+}
@@ -0,0 +1,232 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdollar/backup/internal/files"
+)
+
+// BAR_INTERVAL is how often the terminal bar is redrawn
+const BAR_INTERVAL = 200 * time.Millisecond
+
+// LOG_INTERVAL is how often progress is logged when stdout is not a
+// terminal
+const LOG_INTERVAL = 10 * time.Second
+
+const BAR_WIDTH = 30
+
+// Update describes how far along a long running operation is, such as
+// writing an archive or uploading a file
+type Update struct {
+  Name string
+  File string
+  Done int64
+  Total int64
+  Parts int
+  TotalParts int
+}
+
+// Func receives progress updates. It may be called from several
+// goroutines at once.
+type Func func(Update)
+
+func (u Update) finished() bool {
+  return u.Total > 0 && u.Done >= u.Total
+}
+
+func (u Update) percent() float64 {
+  if u.Total <= 0 {
+    return 0
+  }
+
+  return float64(u.Done) / float64(u.Total) * 100
+}
+
+// Reader calls progress with the bytes read from r so far
+type Reader struct {
+  r io.Reader
+  update Update
+  progress Func
+}
+
+func NewReader(r io.Reader, update Update, progress Func) *Reader {
+  return &Reader{
+    r: r,
+    update: update,
+    progress: progress,
+  }
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+  n, err := r.r.Read(p)
+  if n > 0 && r.progress != nil {
+    r.update.Done += int64(n)
+    r.progress(r.update)
+  }
+
+  return n, err
+}
+
+// Reporter renders updates as a single bar line when out is a terminal
+// and as periodic log lines otherwise. Operations running at the same
+// time share the line.
+type Reporter struct {
+  mu sync.Mutex
+  out *os.File
+  tty bool
+  active map[string]Update
+  order []string
+  reported map[string]time.Time
+  drawn time.Time
+  width int
+}
+
+func NewReporter(out *os.File) *Reporter {
+  return &Reporter{
+    out: out,
+    tty: isTerminal(out),
+    active: map[string]Update{},
+    reported: map[string]time.Time{},
+  }
+}
+
+var defaultReporter *Reporter
+var defaultOnce sync.Once
+
+// Default reports on stdout
+func Default() *Reporter {
+  defaultOnce.Do(func() {
+    defaultReporter = NewReporter(os.Stdout)
+  })
+
+  return defaultReporter
+}
+
+func isTerminal(f *os.File) bool {
+  info, err := f.Stat()
+  if err != nil {
+    return false
+  }
+
+  return info.Mode() & os.ModeCharDevice != 0
+}
+
+// Update is a Func
+func (r *Reporter) Update(u Update) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  if _, ok := r.active[u.Name]; !ok {
+    r.order = append(r.order, u.Name)
+  }
+  r.active[u.Name] = u
+
+  if r.tty {
+    r.draw(u.finished())
+  } else {
+    r.log(u)
+  }
+
+  if u.finished() {
+    r.remove(u.Name)
+  }
+}
+
+func (r *Reporter) remove(name string) {
+  delete(r.active, name)
+  delete(r.reported, name)
+  for i, active := range r.order {
+    if active == name {
+      r.order = append(r.order[:i], r.order[i+1:]...)
+      break
+    }
+  }
+
+  // Leave the finished line on screen once nothing else is running
+  if r.tty && len(r.order) == 0 && r.width > 0 {
+    fmt.Fprintln(r.out)
+    r.width = 0
+  }
+}
+
+func (r *Reporter) log(u Update) {
+  now := time.Now()
+  last, ok := r.reported[u.Name]
+  if ok && now.Sub(last) < LOG_INTERVAL && !u.finished() {
+    return
+  }
+  r.reported[u.Name] = now
+
+  attrs := []any{
+    "name", u.Name,
+    "done", u.Done,
+    "total", u.Total,
+    "percent", fmt.Sprintf("%.1f", u.percent()),
+  }
+  if u.File != "" {
+    attrs = append(attrs, "file", u.File)
+  }
+  if u.TotalParts > 0 {
+    attrs = append(attrs, "parts", u.Parts, "total_parts", u.TotalParts)
+  }
+
+  slog.Info("Progress", attrs...)
+}
+
+func bar(u Update) string {
+  filled := int(u.percent() / 100 * BAR_WIDTH)
+  if filled > BAR_WIDTH {
+    filled = BAR_WIDTH
+  }
+
+  line := fmt.Sprintf(
+    "%s [%s%s] %5.1f%% %s/%s",
+    u.Name,
+    strings.Repeat("=", filled),
+    strings.Repeat(" ", BAR_WIDTH - filled),
+    u.percent(),
+    files.FormatBytes(u.Done),
+    files.FormatBytes(u.Total),
+  )
+  if u.TotalParts > 0 {
+    line += fmt.Sprintf(" %d/%d parts", u.Parts, u.TotalParts)
+  }
+  if u.File != "" {
+    line += " " + u.File
+  }
+
+  return line
+}
+
+func (r *Reporter) draw(force bool) {
+  now := time.Now()
+  if !force && now.Sub(r.drawn) < BAR_INTERVAL {
+    return
+  }
+  r.drawn = now
+
+  names := append([]string{}, r.order...)
+  sort.Strings(names)
+
+  var lines []string
+  for _, name := range names {
+    lines = append(lines, bar(r.active[name]))
+  }
+
+  line := strings.Join(lines, " | ")
+  padding := ""
+  if len(line) < r.width {
+    padding = strings.Repeat(" ", r.width - len(line))
+  }
+  r.width = len(line)
+
+  fmt.Fprint(r.out, "\r" + line + padding)
+}
+
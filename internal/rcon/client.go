@@ -0,0 +1,169 @@
+package rcon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Packet types from the Source RCON protocol used by Minecraft
+const SERVERDATA_AUTH = 3
+const SERVERDATA_AUTH_RESPONSE = 2
+const SERVERDATA_EXECCOMMAND = 2
+const SERVERDATA_RESPONSE_VALUE = 0
+
+// MAX_PACKET_SIZE is the largest packet a server may send
+const MAX_PACKET_SIZE = 4096 + 10
+
+var ErrAuthFailed = errors.New("rcon authentication failed")
+
+type Packet struct {
+  Id int32
+  Type int32
+  Body string
+}
+
+type Client struct {
+  conn net.Conn
+  reader *bufio.Reader
+  timeout time.Duration
+  nextId int32
+}
+
+// Dial connects to an RCON server and authenticates with password
+func Dial(address string, password string, timeout time.Duration) (*Client, error) {
+  conn, err := net.DialTimeout("tcp", address, timeout)
+  if err != nil {
+    return nil, err
+  }
+
+  c := &Client{
+    conn: conn,
+    reader: bufio.NewReader(conn),
+    timeout: timeout,
+  }
+
+  err = c.authenticate(password)
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  return c, nil
+}
+
+func (c *Client) Close() error {
+  return c.conn.Close()
+}
+
+func (c *Client) id() int32 {
+  c.nextId++
+  return c.nextId
+}
+
+func (c *Client) authenticate(password string) error {
+  id := c.id()
+  err := c.WritePacket(Packet{
+    Id: id,
+    Type: SERVERDATA_AUTH,
+    Body: password,
+  })
+  if err != nil {
+    return err
+  }
+
+  // Some servers send an empty response value ahead of the auth response
+  for {
+    packet, err := c.ReadPacket(c.timeout)
+    if err != nil {
+      return err
+    }
+
+    if packet.Type != SERVERDATA_AUTH_RESPONSE {
+      continue
+    }
+
+    if packet.Id == -1 || packet.Id != id {
+      return ErrAuthFailed
+    }
+
+    return nil
+  }
+}
+
+// Command runs a console command and returns the server's response
+func (c *Client) Command(command string) (string, error) {
+  id := c.id()
+  err := c.WritePacket(Packet{
+    Id: id,
+    Type: SERVERDATA_EXECCOMMAND,
+    Body: command,
+  })
+  if err != nil {
+    return "", err
+  }
+
+  for {
+    packet, err := c.ReadPacket(c.timeout)
+    if err != nil {
+      return "", err
+    }
+
+    if packet.Id == id {
+      return packet.Body, nil
+    }
+  }
+}
+
+func (c *Client) WritePacket(packet Packet) error {
+  body := []byte(packet.Body)
+  buf := make([]byte, 14 + len(body))
+  binary.LittleEndian.PutUint32(buf[0:], uint32(10 + len(body)))
+  binary.LittleEndian.PutUint32(buf[4:], uint32(packet.Id))
+  binary.LittleEndian.PutUint32(buf[8:], uint32(packet.Type))
+  copy(buf[12:], body)
+
+  err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+  if err != nil {
+    return err
+  }
+
+  _, err = c.conn.Write(buf)
+  return err
+}
+
+// ReadPacket waits up to timeout for the next packet from the server
+func (c *Client) ReadPacket(timeout time.Duration) (Packet, error) {
+  var packet Packet
+
+  err := c.conn.SetReadDeadline(time.Now().Add(timeout))
+  if err != nil {
+    return packet, err
+  }
+
+  sizeBuf := make([]byte, 4)
+  _, err = io.ReadFull(c.reader, sizeBuf)
+  if err != nil {
+    return packet, err
+  }
+
+  size := int32(binary.LittleEndian.Uint32(sizeBuf))
+  if size < 10 || size > MAX_PACKET_SIZE {
+    return packet, errors.New("rcon packet has invalid size")
+  }
+
+  buf := make([]byte, size)
+  _, err = io.ReadFull(c.reader, buf)
+  if err != nil {
+    return packet, err
+  }
+
+  packet.Id = int32(binary.LittleEndian.Uint32(buf[0:]))
+  packet.Type = int32(binary.LittleEndian.Uint32(buf[4:]))
+  packet.Body = string(buf[8 : size-2])
+
+  return packet, nil
+}
@@ -0,0 +1,123 @@
+package rcon_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jdollar/backup/internal/rcon"
+	"github.com/jdollar/backup/internal/rcon/rcontest"
+)
+
+const TEST_TIMEOUT = 5 * time.Second
+
+func startServer(t *testing.T, password string, handler rcontest.Handler) *rcontest.Server {
+  t.Helper()
+
+  server, err := rcontest.NewServer(password, handler)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(server.Close)
+
+  return server
+}
+
+func dial(t *testing.T, server *rcontest.Server, password string) *rcon.Client {
+  t.Helper()
+
+  client, err := rcon.Dial(server.Addr, password, TEST_TIMEOUT)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { client.Close() })
+
+  return client
+}
+
+func TestDialAuthenticates(t *testing.T) {
+  server := startServer(t, "secret", nil)
+  client := dial(t, server, "secret")
+
+  _, err := client.Command("list")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  commands := server.Commands()
+  if len(commands) != 1 || commands[0] != "list" {
+    t.Errorf("server ran %q, want [list]", commands)
+  }
+}
+
+func TestDialWrongPassword(t *testing.T) {
+  server := startServer(t, "secret", nil)
+
+  _, err := rcon.Dial(server.Addr, "wrong", TEST_TIMEOUT)
+  if err != rcon.ErrAuthFailed {
+    t.Errorf("got %v, want %v", err, rcon.ErrAuthFailed)
+  }
+}
+
+func TestDialSkipsEmptyResponseBeforeAuth(t *testing.T) {
+  server := startServer(t, "secret", nil)
+  server.EmptyBeforeAuth = true
+
+  dial(t, server, "secret")
+
+  _, err := rcon.Dial(server.Addr, "wrong", TEST_TIMEOUT)
+  if err != rcon.ErrAuthFailed {
+    t.Errorf("got %v, want %v", err, rcon.ErrAuthFailed)
+  }
+}
+
+func TestCommandReturnsItsResponse(t *testing.T) {
+  server := startServer(t, "secret", func(conn *rcontest.Conn, request rcon.Packet) {
+    // Output from earlier commands may arrive first
+    conn.Send(rcon.Packet{
+      Id: request.Id + 100,
+      Type: rcon.SERVERDATA_RESPONSE_VALUE,
+      Body: "stale",
+    })
+    conn.Reply(request, "There are 0 of a max of 20 players online: ")
+  })
+  client := dial(t, server, "secret")
+
+  for i := 0; i < 3; i++ {
+    response, err := client.Command("list")
+    if err != nil {
+      t.Fatal(err)
+    }
+    if response != "There are 0 of a max of 20 players online: " {
+      t.Errorf("got response %q", response)
+    }
+  }
+}
+
+func TestCommandLongResponse(t *testing.T) {
+  body := string(bytes.Repeat([]byte("x"), 4096))
+  server := startServer(t, "secret", func(conn *rcontest.Conn, request rcon.Packet) {
+    conn.Reply(request, body)
+  })
+  client := dial(t, server, "secret")
+
+  response, err := client.Command("help")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if response != body {
+    t.Errorf("got %d bytes, want %d", len(response), len(body))
+  }
+}
+
+func TestCommandAfterServerClosed(t *testing.T) {
+  server := startServer(t, "secret", func(conn *rcontest.Conn, request rcon.Packet) {
+    conn.Close()
+  })
+  client := dial(t, server, "secret")
+
+  _, err := client.Command("save-on")
+  if err == nil {
+    t.Error("expected an error from a closed connection")
+  }
+}
@@ -0,0 +1,110 @@
+package rcon
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 5 * time.Second
+
+// pipeClient returns a client on one end of a pipe, the test reads and
+// writes raw bytes on the other
+func pipeClient(t *testing.T) (*Client, net.Conn) {
+  t.Helper()
+
+  server, conn := net.Pipe()
+  t.Cleanup(func() {
+    server.Close()
+    conn.Close()
+  })
+
+  return &Client{
+    conn: conn,
+    reader: bufio.NewReader(conn),
+    timeout: TEST_TIMEOUT,
+  }, server
+}
+
+func TestWritePacketFraming(t *testing.T) {
+  client, server := pipeClient(t)
+
+  go client.WritePacket(Packet{
+    Id: 7,
+    Type: SERVERDATA_EXECCOMMAND,
+    Body: "save-all flush",
+  })
+
+  want := []byte{
+    24, 0, 0, 0,
+    7, 0, 0, 0,
+    2, 0, 0, 0,
+  }
+  want = append(want, "save-all flush"...)
+  want = append(want, 0, 0)
+
+  got := make([]byte, len(want))
+  _, err := io.ReadFull(server, got)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Equal(got, want) {
+    t.Errorf("got % x, want % x", got, want)
+  }
+}
+
+func TestReadPacketFraming(t *testing.T) {
+  client, server := pipeClient(t)
+
+  raw := []byte{
+    24, 0, 0, 0,
+    0xff, 0xff, 0xff, 0xff,
+    0, 0, 0, 0,
+  }
+  raw = append(raw, "Saved the game"...)
+  raw = append(raw, 0, 0)
+  go server.Write(raw)
+
+  packet, err := client.ReadPacket(TEST_TIMEOUT)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  want := Packet{
+    Id: -1,
+    Type: SERVERDATA_RESPONSE_VALUE,
+    Body: "Saved the game",
+  }
+  if packet != want {
+    t.Errorf("got %+v, want %+v", packet, want)
+  }
+}
+
+func TestReadPacketInvalidSize(t *testing.T) {
+  sizes := [][]byte{
+    {9, 0, 0, 0},
+    {0xff, 0xff, 0, 0},
+    {0xff, 0xff, 0xff, 0xff},
+  }
+  for _, size := range sizes {
+    client, server := pipeClient(t)
+    go server.Write(size)
+
+    _, err := client.ReadPacket(TEST_TIMEOUT)
+    if err == nil {
+      t.Errorf("expected an error for size % x", size)
+    }
+  }
+}
+
+func TestReadPacketTimeout(t *testing.T) {
+  client, _ := pipeClient(t)
+
+  _, err := client.ReadPacket(10 * time.Millisecond)
+  if err == nil {
+    t.Error("expected a timeout")
+  }
+}
@@ -0,0 +1,209 @@
+// Package rcontest runs an in-process RCON server for tests
+package rcontest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/jdollar/backup/internal/rcon"
+)
+
+// Handler answers a command sent to the server. It may reply, send
+// further packets or close the connection.
+type Handler func(conn *Conn, request rcon.Packet)
+
+// Server accepts RCON connections on a local port. Packets are framed
+// here rather than with the client's code so tests check the client
+// against the wire format.
+type Server struct {
+  Addr string
+  Password string
+  // EmptyBeforeAuth sends an empty response value ahead of the auth
+  // response, as some servers do. Set it before clients connect.
+  EmptyBeforeAuth bool
+
+  listener net.Listener
+  handler Handler
+  wg sync.WaitGroup
+
+  mu sync.Mutex
+  conns []net.Conn
+  commands []string
+}
+
+// NewServer starts a server that accepts password. Without a handler
+// every command gets an empty reply.
+func NewServer(password string, handler Handler) (*Server, error) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    return nil, err
+  }
+
+  if handler == nil {
+    handler = func(conn *Conn, request rcon.Packet) {
+      conn.Reply(request, "")
+    }
+  }
+
+  s := &Server{
+    Addr: listener.Addr().String(),
+    Password: password,
+    listener: listener,
+    handler: handler,
+  }
+
+  s.wg.Add(1)
+  go s.serve()
+
+  return s, nil
+}
+
+// Close stops the server and drops its connections
+func (s *Server) Close() {
+  s.listener.Close()
+
+  s.mu.Lock()
+  for _, conn := range s.conns {
+    conn.Close()
+  }
+  s.mu.Unlock()
+
+  s.wg.Wait()
+}
+
+// Commands returns the commands run so far, in order
+func (s *Server) Commands() []string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return append([]string(nil), s.commands...)
+}
+
+func (s *Server) serve() {
+  defer s.wg.Done()
+
+  for {
+    netConn, err := s.listener.Accept()
+    if err != nil {
+      return
+    }
+
+    s.mu.Lock()
+    s.conns = append(s.conns, netConn)
+    s.mu.Unlock()
+
+    s.wg.Add(1)
+    go func() {
+      defer s.wg.Done()
+      defer netConn.Close()
+
+      s.handle(&Conn{conn: netConn})
+    }()
+  }
+}
+
+func (s *Server) handle(conn *Conn) {
+  authenticated := false
+  for {
+    request, err := conn.read()
+    if err != nil {
+      return
+    }
+
+    if request.Type == rcon.SERVERDATA_AUTH {
+      authenticated = request.Body == s.Password
+      if s.EmptyBeforeAuth {
+        conn.Reply(request, "")
+      }
+
+      id := request.Id
+      if !authenticated {
+        id = -1
+      }
+      conn.Send(rcon.Packet{
+        Id: id,
+        Type: rcon.SERVERDATA_AUTH_RESPONSE,
+      })
+      continue
+    }
+
+    if !authenticated || request.Type != rcon.SERVERDATA_EXECCOMMAND {
+      return
+    }
+
+    s.mu.Lock()
+    s.commands = append(s.commands, request.Body)
+    s.mu.Unlock()
+
+    s.handler(conn, request)
+  }
+}
+
+// Conn is a client connection to the server
+type Conn struct {
+  conn net.Conn
+  mu sync.Mutex
+}
+
+// Send writes a packet to the client
+func (c *Conn) Send(packet rcon.Packet) error {
+  body := []byte(packet.Body)
+  buf := make([]byte, 4, 14 + len(body))
+  binary.LittleEndian.PutUint32(buf, uint32(10 + len(body)))
+  buf = binary.LittleEndian.AppendUint32(buf, uint32(packet.Id))
+  buf = binary.LittleEndian.AppendUint32(buf, uint32(packet.Type))
+  buf = append(buf, body...)
+  buf = append(buf, 0, 0)
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  _, err := c.conn.Write(buf)
+  return err
+}
+
+// Reply answers request with body
+func (c *Conn) Reply(request rcon.Packet, body string) error {
+  return c.Send(rcon.Packet{
+    Id: request.Id,
+    Type: rcon.SERVERDATA_RESPONSE_VALUE,
+    Body: body,
+  })
+}
+
+// Close drops the connection, as a server that went away would
+func (c *Conn) Close() error {
+  return c.conn.Close()
+}
+
+func (c *Conn) read() (rcon.Packet, error) {
+  var header [12]byte
+  _, err := io.ReadFull(c.conn, header[:])
+  if err != nil {
+    return rcon.Packet{}, err
+  }
+
+  size := int(binary.LittleEndian.Uint32(header[0:]))
+  if size < 10 || size > rcon.MAX_PACKET_SIZE {
+    return rcon.Packet{}, errors.New("rcon packet has invalid size")
+  }
+
+  // The body is followed by two null bytes
+  rest := make([]byte, size - 8)
+  _, err = io.ReadFull(c.conn, rest)
+  if err != nil {
+    return rcon.Packet{}, err
+  }
+  if rest[len(rest) - 2] != 0 || rest[len(rest) - 1] != 0 {
+    return rcon.Packet{}, errors.New("rcon packet is not null terminated")
+  }
+
+  return rcon.Packet{
+    Id: int32(binary.LittleEndian.Uint32(header[4:])),
+    Type: int32(binary.LittleEndian.Uint32(header[8:])),
+    Body: string(rest[:len(rest) - 2]),
+  }, nil
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"io"
+)
+
+// Chunk boundaries are picked with a gear rolling hash so that an
+// insertion only changes the chunks around it instead of shifting every
+// chunk after it
+const MIN_CHUNK_SIZE = 512 * 1024
+const MAX_CHUNK_SIZE = 8 * 1024 * 1024
+
+// AVERAGE_CHUNK_BITS targets chunks of roughly one megabyte
+const AVERAGE_CHUNK_BITS = 20
+
+const chunkMask = uint64(1)<<AVERAGE_CHUNK_BITS - 1
+
+var gearTable [256]uint64
+
+func init() {
+  // The table has to be identical on every run or chunk boundaries, and
+  // with them deduplication, would change between backups
+  seed := uint64(0x6a09e667f3bcc908)
+  for i := range gearTable {
+    seed += 0x9e3779b97f4a7c15
+    z := seed
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+    z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+    gearTable[i] = z ^ (z >> 31)
+  }
+}
+
+type Chunker struct {
+  r io.Reader
+  buf []byte
+  start int
+  end int
+  eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+  return &Chunker{
+    r: r,
+    buf: make([]byte, MAX_CHUNK_SIZE),
+  }
+}
+
+func (c *Chunker) fill() error {
+  copy(c.buf, c.buf[c.start:c.end])
+  c.end -= c.start
+  c.start = 0
+
+  for c.end < len(c.buf) && !c.eof {
+    n, err := c.r.Read(c.buf[c.end:])
+    c.end += n
+    if err == io.EOF {
+      c.eof = true
+      break
+    }
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Next returns the next chunk of data, or io.EOF once the reader is
+// exhausted. The returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+  if c.end-c.start < MAX_CHUNK_SIZE && !c.eof {
+    err := c.fill()
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  data := c.buf[c.start:c.end]
+  if len(data) == 0 {
+    return nil, io.EOF
+  }
+
+  cut := len(data)
+  if len(data) > MIN_CHUNK_SIZE {
+    var h uint64
+    for i, b := range data {
+      h = (h << 1) + gearTable[b]
+      if i >= MIN_CHUNK_SIZE && h&chunkMask == 0 {
+        cut = i + 1
+        break
+      }
+    }
+  }
+
+  c.start += cut
+  return data[:cut], nil
+}
@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// testData is reproducible noise, so chunk boundaries land where they
+// would in real, incompressible data
+func testData(size int, seed uint64) []byte {
+  data := make([]byte, size)
+  for i := range data {
+    seed ^= seed << 13
+    seed ^= seed >> 7
+    seed ^= seed << 17
+    data[i] = byte(seed)
+  }
+
+  return data
+}
+
+func chunkData(t *testing.T, r io.Reader) [][]byte {
+  t.Helper()
+
+  var chunks [][]byte
+  chunker := NewChunker(r)
+  for {
+    chunk, err := chunker.Next()
+    if err == io.EOF {
+      return chunks
+    }
+    if err != nil {
+      t.Fatal(err)
+    }
+    chunks = append(chunks, append([]byte(nil), chunk...))
+  }
+}
+
+func chunkSizes(chunks [][]byte) []int {
+  var sizes []int
+  for _, chunk := range chunks {
+    sizes = append(sizes, len(chunk))
+  }
+
+  return sizes
+}
+
+func TestChunkerSizes(t *testing.T) {
+  tests := []struct {
+    name string
+    size int
+  }{
+    {"empty", 0},
+    {"under minimum", MIN_CHUNK_SIZE - 1},
+    {"minimum", MIN_CHUNK_SIZE},
+    {"one maximum", MAX_CHUNK_SIZE},
+    {"several chunks", 12 * 1024 * 1024},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      data := testData(test.size, 1)
+      chunks := chunkData(t, bytes.NewReader(data))
+
+      if !bytes.Equal(bytes.Join(chunks, nil), data) {
+        t.Fatal("chunks do not add up to the data")
+      }
+
+      for i, chunk := range chunks {
+        if len(chunk) > MAX_CHUNK_SIZE {
+          t.Errorf("chunk %d is %d bytes, over the maximum", i, len(chunk))
+        }
+        if i < len(chunks)-1 && len(chunk) < MIN_CHUNK_SIZE {
+          t.Errorf("chunk %d is %d bytes, under the minimum", i, len(chunk))
+        }
+      }
+    })
+  }
+}
+
+// Boundaries depend only on the data, the repository relies on that to
+// deduplicate across backups
+func TestChunkerBoundariesIgnoreReads(t *testing.T) {
+  data := testData(12 * 1024 * 1024, 2)
+  want := chunkSizes(chunkData(t, bytes.NewReader(data)))
+  if len(want) < 4 {
+    t.Fatalf("only %d chunks, the test data is too small", len(want))
+  }
+
+  tests := []struct {
+    name string
+    reader io.Reader
+  }{
+    {"half reads", iotest.HalfReader(bytes.NewReader(data))},
+    {"one byte reads", iotest.OneByteReader(bytes.NewReader(data))},
+    {"eof with data", iotest.DataErrReader(bytes.NewReader(data))},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      got := chunkSizes(chunkData(t, test.reader))
+      if !reflect.DeepEqual(got, want) {
+        t.Errorf("chunk sizes %v, want %v", got, want)
+      }
+    })
+  }
+}
+
+// An edit only changes the chunks around it, every other chunk is
+// stored again under the same id
+func TestChunkerBoundariesAfterEdit(t *testing.T) {
+  data := testData(24 * 1024 * 1024, 3)
+  middle := len(data) / 2
+
+  tests := []struct {
+    name string
+    edit func([]byte) []byte
+  }{
+    {"insert at start", func(data []byte) []byte {
+      return append([]byte("inserted"), data...)
+    }},
+    {"insert in middle", func(data []byte) []byte {
+      edited := append([]byte(nil), data[:middle]...)
+      edited = append(edited, testData(1000, 4)...)
+      return append(edited, data[middle:]...)
+    }},
+    {"delete in middle", func(data []byte) []byte {
+      edited := append([]byte(nil), data[:middle]...)
+      return append(edited, data[middle+1000:]...)
+    }},
+    {"change one byte", func(data []byte) []byte {
+      edited := append([]byte(nil), data...)
+      edited[middle]++
+      return edited
+    }},
+    {"append", func(data []byte) []byte {
+      return append(append([]byte(nil), data...), testData(1000, 5)...)
+    }},
+  }
+
+  original := map[[sha256.Size]byte]bool{}
+  originalChunks := chunkData(t, bytes.NewReader(data))
+  for _, chunk := range originalChunks {
+    original[sha256.Sum256(chunk)] = true
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      chunks := chunkData(t, bytes.NewReader(test.edit(data)))
+
+      changed := 0
+      for _, chunk := range chunks {
+        if !original[sha256.Sum256(chunk)] {
+          changed++
+        }
+      }
+
+      // The chunk holding the edit, and at most one more when the edit
+      // moves a boundary
+      if changed > 2 {
+        t.Errorf("%d of %d chunks changed", changed, len(chunks))
+      }
+    })
+  }
+}
+
+// The gear table, and with it every chunk boundary, must never change
+// or backups made before the change stop deduplicating against new ones
+func TestChunkerGolden(t *testing.T) {
+  want := []int{1580644, 962733, 1181704, 2720766, 673001, 698049, 1720950, 2859513, 185552}
+  got := chunkSizes(chunkData(t, bytes.NewReader(testData(12 * 1024 * 1024, 6))))
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("chunk sizes %v, want %v", got, want)
+  }
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// PACK_SIZE is the size a pack grows to before it is uploaded
+const PACK_SIZE = 16 * 1024 * 1024
+
+const PACK_PREFIX = "pack-"
+
+// packBlob locates one compressed chunk inside a pack
+type packBlob struct {
+  Id string `json:"id"`
+  Offset int64 `json:"offset"`
+  Length int64 `json:"length"`
+}
+
+// packWriter collects compressed chunks in a temporary file. Packs end
+// with a json header listing their blobs followed by its length as a
+// big endian uint32, so a pack can be read back without the index.
+type packWriter struct {
+  file *os.File
+  hash hash.Hash
+  size int64
+  blobs []packBlob
+}
+
+func newPackWriter() (*packWriter, error) {
+  file, err := ioutil.TempFile("", PACK_PREFIX)
+  if err != nil {
+    return nil, err
+  }
+
+  return &packWriter{
+    file: file,
+    hash: sha256.New(),
+  }, nil
+}
+
+func (p *packWriter) write(data []byte) error {
+  _, err := io.MultiWriter(p.file, p.hash).Write(data)
+  if err != nil {
+    return err
+  }
+
+  p.size += int64(len(data))
+  return nil
+}
+
+func (p *packWriter) add(id string, data []byte) error {
+  var buf bytes.Buffer
+  gw := gzip.NewWriter(&buf)
+  _, err := gw.Write(data)
+  if err != nil {
+    return err
+  }
+
+  err = gw.Close()
+  if err != nil {
+    return err
+  }
+
+  p.blobs = append(p.blobs, packBlob{
+    Id: id,
+    Offset: p.size,
+    Length: int64(buf.Len()),
+  })
+
+  return p.write(buf.Bytes())
+}
+
+// finish writes the pack header and returns the pack name, ready to be
+// read back from the start of the file
+func (p *packWriter) finish() (string, error) {
+  header, err := json.Marshal(p.blobs)
+  if err != nil {
+    return "", err
+  }
+
+  err = p.write(header)
+  if err != nil {
+    return "", err
+  }
+
+  length := make([]byte, 4)
+  binary.BigEndian.PutUint32(length, uint32(len(header)))
+  err = p.write(length)
+  if err != nil {
+    return "", err
+  }
+
+  _, err = p.file.Seek(0, io.SeekStart)
+  if err != nil {
+    return "", err
+  }
+
+  return PACK_PREFIX + hex.EncodeToString(p.hash.Sum(nil)), nil
+}
+
+func (p *packWriter) close() {
+  p.file.Close()
+  os.Remove(p.file.Name())
+}
+
+// readBlob decompresses a chunk from a pack and checks it against its id
+func readBlob(pack io.ReaderAt, id string, offset int64, length int64) ([]byte, error) {
+  gr, err := gzip.NewReader(io.NewSectionReader(pack, offset, length))
+  if err != nil {
+    return nil, err
+  }
+  defer gr.Close()
+
+  data, err := ioutil.ReadAll(gr)
+  if err != nil {
+    return nil, err
+  }
+
+  sum := sha256.Sum256(data)
+  if hex.EncodeToString(sum[:]) != id {
+    return nil, errors.New("chunk " + id + " is corrupted")
+  }
+
+  return data, nil
+}
@@ -0,0 +1,659 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/storage"
+)
+
+const CONFIG_NAME = "repository.json"
+const INDEX_PREFIX = "index-"
+const SNAPSHOT_PREFIX = "snapshot-"
+
+const REPOSITORY_VERSION = 1
+
+type repositoryConfig struct {
+  Version int `json:"version"`
+  MinChunkSize int `json:"min_chunk_size"`
+  MaxChunkSize int `json:"max_chunk_size"`
+  AverageChunkBits int `json:"average_chunk_bits"`
+}
+
+type blobLocation struct {
+  Pack string
+  Offset int64
+  Length int64
+}
+
+// indexFile maps pack names to the blobs stored in them
+type indexFile struct {
+  Packs map[string][]packBlob `json:"packs"`
+}
+
+// Node is a single file in a snapshot tree
+type Node struct {
+  Path string `json:"path"`
+  Mode os.FileMode `json:"mode"`
+  ModTime time.Time `json:"mtime"`
+  Size int64 `json:"size"`
+  Chunks []string `json:"chunks"`
+}
+
+// Snapshot is the tree of files captured by one backup. It only holds
+// chunk ids, the data itself lives in packs shared by every snapshot.
+type Snapshot struct {
+  Name string `json:"-"`
+  Time time.Time `json:"time"`
+  Paths []string `json:"paths"`
+  Nodes []Node `json:"nodes"`
+}
+
+type BackupStats struct {
+  Files int
+  Bytes int64
+  NewChunks int
+  NewBytes int64
+  Packs int
+}
+
+type PruneStats struct {
+  Snapshots int
+  Packs int
+}
+
+// Repository is a content addressed store of deduplicated chunks on a
+// storage backend
+type Repository struct {
+  backend storage.Backend
+  index map[string]blobLocation
+  indexFiles []string
+  packs map[string]bool
+}
+
+func Init(ctx context.Context, backend storage.Backend) error {
+  _, err := backend.Open(ctx, CONFIG_NAME)
+  if err == nil {
+    return errors.New("Repository is already initialized")
+  }
+  if !errors.Is(err, storage.ErrNotFound) {
+    return err
+  }
+
+  return saveJSON(ctx, backend, CONFIG_NAME, repositoryConfig{
+    Version: REPOSITORY_VERSION,
+    MinChunkSize: MIN_CHUNK_SIZE,
+    MaxChunkSize: MAX_CHUNK_SIZE,
+    AverageChunkBits: AVERAGE_CHUNK_BITS,
+  })
+}
+
+func Open(ctx context.Context, backend storage.Backend) (*Repository, error) {
+  var conf repositoryConfig
+  err := loadJSON(ctx, backend, CONFIG_NAME, &conf)
+  if errors.Is(err, storage.ErrNotFound) {
+    return nil, errors.New("Repository is not initialized")
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  if conf.Version != REPOSITORY_VERSION {
+    return nil, errors.New("Unsupported repository version " + strconv.Itoa(conf.Version))
+  }
+
+  r := &Repository{
+    backend: backend,
+    index: map[string]blobLocation{},
+    packs: map[string]bool{},
+  }
+
+  objects, err := backend.List(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  for _, object := range objects {
+    if strings.HasPrefix(object.Name, PACK_PREFIX) {
+      r.packs[object.Name] = true
+    }
+  }
+
+  for _, object := range objects {
+    if !strings.HasPrefix(object.Name, INDEX_PREFIX) {
+      continue
+    }
+
+    var index indexFile
+    err := loadJSON(ctx, backend, object.Name, &index)
+    if err != nil {
+      return nil, err
+    }
+
+    r.addIndex(index)
+    r.indexFiles = append(r.indexFiles, object.Name)
+  }
+
+  return r, nil
+}
+
+func (r *Repository) addIndex(index indexFile) {
+  for pack, blobs := range index.Packs {
+    // A pack missing from the backend was never fully uploaded
+    if !r.packs[pack] {
+      continue
+    }
+
+    for _, blob := range blobs {
+      r.index[blob.Id] = blobLocation{
+        Pack: pack,
+        Offset: blob.Offset,
+        Length: blob.Length,
+      }
+    }
+  }
+}
+
+func saveJSON(ctx context.Context, backend storage.Backend, name string, v interface{}) error {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+
+  _, err = backend.Save(ctx, name, bytes.NewReader(data), int64(len(data)))
+  return err
+}
+
+func loadJSON(ctx context.Context, backend storage.Backend, name string, v interface{}) error {
+  r, err := backend.Open(ctx, name)
+  if err != nil {
+    return err
+  }
+  defer r.Close()
+
+  return json.NewDecoder(r).Decode(v)
+}
+
+// saveIndex writes an index for the given packs under a name derived
+// from its contents
+func (r *Repository) saveIndex(ctx context.Context, index indexFile) (string, error) {
+  data, err := json.Marshal(index)
+  if err != nil {
+    return "", err
+  }
+
+  sum := sha256.Sum256(data)
+  name := INDEX_PREFIX + hex.EncodeToString(sum[:]) + ".json"
+
+  // The same contents were saved before, by a run that was interrupted
+  // or a prune that kept the same packs
+  _, err = r.backend.Save(ctx, name, bytes.NewReader(data), int64(len(data)))
+  if err != nil && !errors.Is(err, storage.ErrExists) {
+    return "", err
+  }
+
+  for _, existing := range r.indexFiles {
+    if existing == name {
+      return name, nil
+    }
+  }
+
+  r.indexFiles = append(r.indexFiles, name)
+  return name, nil
+}
+
+// backupSession tracks the pack currently being filled and the chunks
+// written during one backup
+type backupSession struct {
+  repo *Repository
+  pack *packWriter
+  pending map[string]bool
+  index indexFile
+  stats BackupStats
+}
+
+func (s *backupSession) flush(ctx context.Context) error {
+  if s.pack == nil {
+    return nil
+  }
+  defer s.pack.close()
+
+  name, err := s.pack.finish()
+  if err != nil {
+    return err
+  }
+
+  slog.Info("Uploading", "object", name)
+  // Packs are named after their contents, one left behind by an
+  // interrupted run holds exactly these chunks
+  _, err = s.repo.backend.Save(ctx, name, s.pack.file, s.pack.size)
+  if err != nil && !errors.Is(err, storage.ErrExists) {
+    return err
+  }
+
+  s.repo.packs[name] = true
+  s.index.Packs[name] = s.pack.blobs
+  for _, blob := range s.pack.blobs {
+    s.repo.index[blob.Id] = blobLocation{
+      Pack: name,
+      Offset: blob.Offset,
+      Length: blob.Length,
+    }
+  }
+
+  s.stats.Packs++
+  s.pack = nil
+
+  return nil
+}
+
+func (s *backupSession) addChunk(ctx context.Context, data []byte) (string, error) {
+  sum := sha256.Sum256(data)
+  id := hex.EncodeToString(sum[:])
+
+  if _, ok := s.repo.index[id]; ok || s.pending[id] {
+    return id, nil
+  }
+
+  if s.pack == nil {
+    pack, err := newPackWriter()
+    if err != nil {
+      return id, err
+    }
+    s.pack = pack
+  }
+
+  err := s.pack.add(id, data)
+  if err != nil {
+    return id, err
+  }
+
+  s.pending[id] = true
+  s.stats.NewChunks++
+  s.stats.NewBytes += int64(len(data))
+
+  if s.pack.size >= PACK_SIZE {
+    return id, s.flush(ctx)
+  }
+
+  return id, nil
+}
+
+func (s *backupSession) addFile(ctx context.Context, path string, info os.FileInfo) (Node, error) {
+  node := Node{
+    Path: path,
+    Mode: info.Mode(),
+    ModTime: info.ModTime(),
+    Size: info.Size(),
+  }
+
+  file, err := os.Open(path)
+  if err != nil {
+    return node, err
+  }
+  defer file.Close()
+
+  chunker := NewChunker(file)
+  for {
+    data, err := chunker.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return node, err
+    }
+
+    id, err := s.addChunk(ctx, data)
+    if err != nil {
+      return node, err
+    }
+
+    node.Chunks = append(node.Chunks, id)
+  }
+
+  s.stats.Files++
+  s.stats.Bytes += info.Size()
+
+  return node, nil
+}
+
+// Backup chunks the files, uploads packs holding any chunk the
+// repository does not have yet and records a new snapshot
+func (r *Repository) Backup(ctx context.Context, paths []string, files []string, now time.Time) (Snapshot, BackupStats, error) {
+  session := &backupSession{
+    repo: r,
+    pending: map[string]bool{},
+    index: indexFile{
+      Packs: map[string][]packBlob{},
+    },
+  }
+  defer func() {
+    if session.pack != nil {
+      session.pack.close()
+    }
+  }()
+
+  snapshot := Snapshot{
+    Name: SNAPSHOT_PREFIX + strconv.FormatInt(now.UTC().UnixMilli(), 10) + ".json",
+    Time: now.UTC(),
+    Paths: paths,
+  }
+
+  for _, path := range files {
+    if ctx.Err() != nil {
+      return snapshot, session.stats, ctx.Err()
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+      return snapshot, session.stats, err
+    }
+
+    slog.Debug("Adding file to snapshot", "file", path)
+    node, err := session.addFile(ctx, path, info)
+    if err != nil {
+      return snapshot, session.stats, err
+    }
+
+    snapshot.Nodes = append(snapshot.Nodes, node)
+  }
+
+  err := session.flush(ctx)
+  if err != nil {
+    return snapshot, session.stats, err
+  }
+
+  // The index has to be stored before the snapshot so a snapshot never
+  // references chunks that cannot be located
+  if len(session.index.Packs) > 0 {
+    _, err = r.saveIndex(ctx, session.index)
+    if err != nil {
+      return snapshot, session.stats, err
+    }
+  }
+
+  err = saveJSON(ctx, r.backend, snapshot.Name, snapshot)
+  return snapshot, session.stats, err
+}
+
+type BySnapshotName []Snapshot
+
+func (a BySnapshotName) Len() int           { return len(a) }
+func (a BySnapshotName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BySnapshotName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Snapshots returns every snapshot in the repository, oldest first
+func (r *Repository) Snapshots(ctx context.Context) ([]Snapshot, error) {
+  objects, err := r.backend.List(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  var snapshots []Snapshot
+  for _, object := range objects {
+    if !strings.HasPrefix(object.Name, SNAPSHOT_PREFIX) {
+      continue
+    }
+
+    snapshot, err := r.LoadSnapshot(ctx, object.Name)
+    if err != nil {
+      return nil, err
+    }
+
+    snapshots = append(snapshots, snapshot)
+  }
+
+  sort.Sort(BySnapshotName(snapshots))
+  return snapshots, nil
+}
+
+func (r *Repository) LoadSnapshot(ctx context.Context, name string) (Snapshot, error) {
+  var snapshot Snapshot
+  err := loadJSON(ctx, r.backend, name, &snapshot)
+  snapshot.Name = name
+  return snapshot, err
+}
+
+// packCache keeps downloaded packs in a temporary directory so each
+// pack is only fetched once per restore
+type packCache struct {
+  backend storage.Backend
+  dir string
+  files map[string]*os.File
+}
+
+func newPackCache(backend storage.Backend) (*packCache, error) {
+  dir, err := ioutil.TempDir("", "backup-restore")
+  if err != nil {
+    return nil, err
+  }
+
+  return &packCache{
+    backend: backend,
+    dir: dir,
+    files: map[string]*os.File{},
+  }, nil
+}
+
+func (c *packCache) get(ctx context.Context, name string) (*os.File, error) {
+  if file, ok := c.files[name]; ok {
+    return file, nil
+  }
+
+  slog.Debug("Downloading", "object", name)
+  r, err := c.backend.Open(ctx, name)
+  if err != nil {
+    return nil, err
+  }
+  defer r.Close()
+
+  file, err := os.Create(filepath.Join(c.dir, name))
+  if err != nil {
+    return nil, err
+  }
+
+  _, err = io.Copy(file, r)
+  if err != nil {
+    file.Close()
+    return nil, err
+  }
+
+  c.files[name] = file
+  return file, nil
+}
+
+func (c *packCache) close() {
+  for _, file := range c.files {
+    file.Close()
+  }
+  os.RemoveAll(c.dir)
+}
+
+// safeJoin keeps snapshot paths from escaping the restore target
+func safeJoin(target string, name string) string {
+  cleaned := filepath.Clean(string(filepath.Separator) + name)
+  return filepath.Join(target, cleaned)
+}
+
+func (r *Repository) restoreNode(ctx context.Context, cache *packCache, node Node, target string) error {
+  path := safeJoin(target, node.Path)
+  err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+  if err != nil {
+    return err
+  }
+
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, node.Mode.Perm())
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  for _, id := range node.Chunks {
+    location, ok := r.index[id]
+    if !ok {
+      return errors.New("chunk " + id + " of " + node.Path + " is missing from the repository")
+    }
+
+    pack, err := cache.get(ctx, location.Pack)
+    if err != nil {
+      return err
+    }
+
+    data, err := readBlob(pack, id, location.Offset, location.Length)
+    if err != nil {
+      return err
+    }
+
+    _, err = file.Write(data)
+    if err != nil {
+      return err
+    }
+  }
+
+  err = file.Close()
+  if err != nil {
+    return err
+  }
+
+  return os.Chtimes(path, node.ModTime, node.ModTime)
+}
+
+// Restore writes every file of the snapshot below target
+func (r *Repository) Restore(ctx context.Context, snapshot Snapshot, target string) error {
+  cache, err := newPackCache(r.backend)
+  if err != nil {
+    return err
+  }
+  defer cache.close()
+
+  for _, node := range snapshot.Nodes {
+    slog.Debug("Restoring file", "file", node.Path)
+    err := r.restoreNode(ctx, cache, node, target)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Prune removes all but the newest keep snapshots and deletes packs no
+// remaining snapshot references. Packs that are only partly referenced
+// are kept as is.
+func (r *Repository) Prune(ctx context.Context, keep int) (PruneStats, error) {
+  var stats PruneStats
+
+  snapshots, err := r.Snapshots(ctx)
+  if err != nil {
+    return stats, err
+  }
+
+  if len(snapshots) > keep {
+    for _, snapshot := range snapshots[:len(snapshots)-keep] {
+      slog.Info("Removing snapshot", "snapshot", snapshot.Name)
+      err := r.backend.Remove(ctx, snapshot.Name)
+      if err != nil {
+        return stats, err
+      }
+      stats.Snapshots++
+    }
+    snapshots = snapshots[len(snapshots)-keep:]
+  }
+
+  referenced := map[string]bool{}
+  for _, snapshot := range snapshots {
+    for _, node := range snapshot.Nodes {
+      for _, id := range node.Chunks {
+        referenced[r.index[id].Pack] = true
+      }
+    }
+  }
+
+  dropped := false
+  for pack := range r.packs {
+    if !referenced[pack] {
+      dropped = true
+      break
+    }
+  }
+
+  // Rewriting an unchanged index would only rename it
+  if stats.Snapshots == 0 && !dropped {
+    return stats, nil
+  }
+
+  packBlobs := map[string][]packBlob{}
+  for id, location := range r.index {
+    packBlobs[location.Pack] = append(packBlobs[location.Pack], packBlob{
+      Id: id,
+      Offset: location.Offset,
+      Length: location.Length,
+    })
+  }
+
+  // Write the compacted index before deleting anything so an
+  // interrupted prune leaves a usable repository behind
+  index := indexFile{
+    Packs: map[string][]packBlob{},
+  }
+  for pack, blobs := range packBlobs {
+    if referenced[pack] {
+      // Map order would otherwise give the same index a new name
+      sort.Slice(blobs, func(i, j int) bool {
+        return blobs[i].Offset < blobs[j].Offset
+      })
+      index.Packs[pack] = blobs
+    }
+  }
+
+  oldIndexFiles := r.indexFiles
+  r.indexFiles = nil
+  newIndex, err := r.saveIndex(ctx, index)
+  if err != nil {
+    return stats, err
+  }
+
+  for _, name := range oldIndexFiles {
+    if name == newIndex {
+      continue
+    }
+
+    err := r.backend.Remove(ctx, name)
+    if err != nil {
+      return stats, err
+    }
+  }
+
+  for pack := range r.packs {
+    if referenced[pack] {
+      continue
+    }
+
+    slog.Info("Removing pack", "object", pack)
+    err := r.backend.Remove(ctx, pack)
+    if err != nil {
+      return stats, err
+    }
+
+    delete(r.packs, pack)
+    stats.Packs++
+  }
+
+  r.index = map[string]blobLocation{}
+  r.addIndex(index)
+
+  return stats, nil
+}
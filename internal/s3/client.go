@@ -0,0 +1,391 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdollar/backup/internal/progress"
+)
+
+// PART_SIZE is the size of each part of a multipart upload, which is
+// also how much of an object is held in memory. S3 allows 10000 parts
+// so objects up to about 160 GB can be uploaded.
+const PART_SIZE = 16*1024*1024
+const MAX_PARTS = 10000
+
+// ABORT_TIMEOUT bounds aborting a multipart upload, which happens after
+// the upload's own context may already be cancelled
+const ABORT_TIMEOUT = 30 * time.Second
+
+const DEFAULT_REGION = "us-east-1"
+
+// ClientOpts configures a client. Without an Endpoint the bucket is
+// addressed as a subdomain of the AWS endpoint for Region, services
+// given by Endpoint are addressed with the bucket in the path.
+type ClientOpts struct {
+  Endpoint string
+  Region string
+  Bucket string
+  AccessKeyId string
+  SecretAccessKey string
+  SessionToken string
+}
+
+type Client struct {
+  httpClient *http.Client
+  opts ClientOpts
+  baseUrl *url.URL
+  progress progress.Func
+}
+
+func NewClient(copts ClientOpts) (Client, error) {
+  if copts.Bucket == "" {
+    return Client{}, errors.New("Missing S3 bucket")
+  }
+  if copts.Region == "" {
+    copts.Region = DEFAULT_REGION
+  }
+
+  endpoint := "https://" + copts.Bucket + ".s3." + copts.Region + ".amazonaws.com"
+  if copts.Endpoint != "" {
+    endpoint = strings.TrimSuffix(copts.Endpoint, "/") + "/" + copts.Bucket
+  }
+
+  baseUrl, err := url.Parse(endpoint)
+  if err != nil {
+    return Client{}, err
+  }
+
+  return Client{
+    httpClient: http.DefaultClient,
+    opts: copts,
+    baseUrl: baseUrl,
+  }, nil
+}
+
+// SetProgress reports the progress of uploads to report, with the key
+// as the update name
+func (c *Client) SetProgress(report progress.Func) {
+  c.progress = report
+}
+
+func (c *Client) reportProgress(update progress.Update) {
+  if c.progress != nil {
+    c.progress(update)
+  }
+}
+
+// newRequest builds a signed request for key, the bucket itself when
+// key is empty. The body is held in memory so it can be hashed.
+func (c *Client) newRequest(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Request, error) {
+  u := *c.baseUrl
+  u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+  u.RawPath = uriEncode(u.Path, true)
+  u.RawQuery = query.Encode()
+
+  req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+  if err != nil {
+    return nil, err
+  }
+
+  payloadHash := EMPTY_PAYLOAD_HASH
+  if len(body) > 0 {
+    payloadHash = hashHex(body)
+  }
+  c.sign(req, payloadHash, time.Now())
+
+  return req, nil
+}
+
+// handleResponse decodes a successful XML response into result. Any
+// other status is returned as a *ClientError.
+func (c *Client) handleResponse(resp *http.Response, result interface{}) error {
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    // HEAD requests and some proxies fail without a body, the status is
+    // enough to tell them apart
+    errResp := &ClientError{}
+    xml.NewDecoder(resp.Body).Decode(errResp)
+    errResp.Status = resp.StatusCode
+
+    slog.Debug(
+      "S3 request failed",
+      "status", errResp.Status,
+      "code", errResp.Code,
+      "request_id", errResp.RequestId,
+      "error", errResp.Message,
+    )
+    return errResp
+  }
+
+  if result != nil {
+    return xml.NewDecoder(resp.Body).Decode(result)
+  }
+
+  return nil
+}
+
+func (c *Client) makeRequest(req *http.Request, result interface{}) (*http.Response, error) {
+  rawResp, err := c.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  defer rawResp.Body.Close()
+
+  return rawResp, c.handleResponse(rawResp, result)
+}
+
+// ListObjects lists a page of the objects whose keys start with prefix,
+// leaving out keys with a further slash. Pass the previous page's
+// NextContinuationToken to get the next one.
+func (c *Client) ListObjects(ctx context.Context, prefix string, continuationToken string) (ListObjectsResponse, error) {
+  var resp ListObjectsResponse
+
+  query := url.Values{}
+  query.Set("list-type", "2")
+  query.Set("prefix", prefix)
+  query.Set("delimiter", "/")
+  if continuationToken != "" {
+    query.Set("continuation-token", continuationToken)
+  }
+
+  req, err := c.newRequest(ctx, http.MethodGet, "", query, nil)
+  if err != nil {
+    return resp, err
+  }
+
+  _, err = c.makeRequest(req, &resp)
+  return resp, err
+}
+
+// GetObject opens the contents of an object for reading. The caller is
+// responsible for closing the returned reader
+func (c *Client) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+  req, err := c.newRequest(ctx, http.MethodGet, key, nil, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  rawResp, err := c.httpClient.Do(req)
+  if err != nil {
+    return nil, err
+  }
+
+  if rawResp.StatusCode < 200 || rawResp.StatusCode >= 300 {
+    defer rawResp.Body.Close()
+    return nil, c.handleResponse(rawResp, nil)
+  }
+
+  return rawResp.Body, nil
+}
+
+// DeleteObject removes an object, S3 reports success when it does not
+// exist
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+  req, err := c.newRequest(ctx, http.MethodDelete, key, nil, nil)
+  if err != nil {
+    return err
+  }
+
+  _, err = c.makeRequest(req, nil)
+  return err
+}
+
+func (c *Client) PutObject(ctx context.Context, key string, data []byte) (Object, error) {
+  req, err := c.newRequest(ctx, http.MethodPut, key, nil, data)
+  if err != nil {
+    return Object{}, err
+  }
+
+  resp, err := c.makeRequest(req, nil)
+  if err != nil {
+    return Object{}, err
+  }
+
+  return Object{
+    Key: key,
+    Size: int64(len(data)),
+    ETag: resp.Header.Get("ETag"),
+  }, nil
+}
+
+func (c *Client) CreateMultipartUpload(ctx context.Context, key string) (CreateMultipartUploadResponse, error) {
+  var resp CreateMultipartUploadResponse
+
+  query := url.Values{}
+  query.Set("uploads", "")
+
+  req, err := c.newRequest(ctx, http.MethodPost, key, query, nil)
+  if err != nil {
+    return resp, err
+  }
+
+  _, err = c.makeRequest(req, &resp)
+  return resp, err
+}
+
+func (c *Client) UploadPart(ctx context.Context, key string, uploadId string, partNumber int, data []byte) (CompletedPart, error) {
+  query := url.Values{}
+  query.Set("uploadId", uploadId)
+  query.Set("partNumber", strconv.Itoa(partNumber))
+
+  req, err := c.newRequest(ctx, http.MethodPut, key, query, data)
+  if err != nil {
+    return CompletedPart{}, err
+  }
+
+  logger := slog.With("key", key, "part", partNumber, "size", len(data))
+  logger.Debug("Uploading part")
+  resp, err := c.makeRequest(req, nil)
+  if err != nil {
+    return CompletedPart{}, err
+  }
+  logger.Debug("Finished uploading part")
+
+  return CompletedPart{
+    PartNumber: partNumber,
+    ETag: resp.Header.Get("ETag"),
+  }, nil
+}
+
+func (c *Client) CompleteMultipartUpload(ctx context.Context, key string, uploadId string, parts []CompletedPart) (CompleteMultipartUploadResponse, error) {
+  var resp CompleteMultipartUploadResponse
+
+  body, err := xml.Marshal(CompleteMultipartUploadRequest{
+    Parts: parts,
+  })
+  if err != nil {
+    return resp, err
+  }
+
+  query := url.Values{}
+  query.Set("uploadId", uploadId)
+
+  req, err := c.newRequest(ctx, http.MethodPost, key, query, body)
+  if err != nil {
+    return resp, err
+  }
+
+  _, err = c.makeRequest(req, &resp)
+  return resp, err
+}
+
+// AbortMultipartUpload discards a multipart upload along with the parts
+// already uploaded to it
+func (c *Client) AbortMultipartUpload(ctx context.Context, key string, uploadId string) error {
+  query := url.Values{}
+  query.Set("uploadId", uploadId)
+
+  req, err := c.newRequest(ctx, http.MethodDelete, key, query, nil)
+  if err != nil {
+    return err
+  }
+
+  _, err = c.makeRequest(req, nil)
+  return err
+}
+
+// Upload stores everything read from r as key. size is only used for
+// the progress and may be -1 when unknown. Objects that fit in a single
+// part are put directly, anything larger goes through a multipart
+// upload which is aborted when it fails.
+func (c *Client) Upload(ctx context.Context, key string, r io.Reader, size int64) (Object, error) {
+  if size < 0 {
+    size = 0
+  }
+
+  buf := make([]byte, PART_SIZE)
+  n, err := io.ReadFull(r, buf)
+  if err == io.EOF || err == io.ErrUnexpectedEOF {
+    object, err := c.PutObject(ctx, key, buf[:n])
+    if err != nil {
+      return object, err
+    }
+
+    c.reportProgress(progress.Update{
+      Name: key,
+      Done: int64(n),
+      Total: size,
+    })
+    return object, nil
+  }
+  if err != nil {
+    return Object{}, err
+  }
+
+  slog.Debug("Creating multipart upload", "key", key)
+  upload, err := c.CreateMultipartUpload(ctx, key)
+  if err != nil {
+    return Object{}, err
+  }
+
+  object, err := c.uploadParts(ctx, key, upload.UploadId, buf, r, size)
+  if err != nil {
+    // Parts of an abandoned upload are stored, and billed, until the
+    // upload is aborted
+    abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), ABORT_TIMEOUT)
+    defer cancel()
+
+    abortErr := c.AbortMultipartUpload(abortCtx, key, upload.UploadId)
+    if abortErr != nil {
+      slog.Warn("Error aborting multipart upload", "key", key, "upload", upload.UploadId, "error", abortErr)
+    }
+    return Object{}, err
+  }
+
+  return object, nil
+}
+
+// uploadParts sends the full first part in buf and the rest of r as the
+// parts of a multipart upload, then completes it
+func (c *Client) uploadParts(ctx context.Context, key string, uploadId string, buf []byte, r io.Reader, size int64) (Object, error) {
+  var parts []CompletedPart
+  var done int64
+  n := len(buf)
+  totalParts := int((size + PART_SIZE - 1) / PART_SIZE)
+
+  for partNumber := 1; n > 0; partNumber++ {
+    if partNumber > MAX_PARTS {
+      return Object{}, errors.New("Object " + key + " needs more than " + strconv.Itoa(MAX_PARTS) + " parts")
+    }
+
+    part, err := c.UploadPart(ctx, key, uploadId, partNumber, buf[:n])
+    if err != nil {
+      return Object{}, err
+    }
+    parts = append(parts, part)
+
+    done += int64(n)
+    c.reportProgress(progress.Update{
+      Name: key,
+      Done: done,
+      Total: size,
+      Parts: partNumber,
+      TotalParts: totalParts,
+    })
+
+    n, err = io.ReadFull(r, buf)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      return Object{}, err
+    }
+  }
+
+  completed, err := c.CompleteMultipartUpload(ctx, key, uploadId, parts)
+  if err != nil {
+    return Object{}, err
+  }
+
+  return Object{
+    Key: key,
+    Size: done,
+    ETag: completed.ETag,
+  }, nil
+}
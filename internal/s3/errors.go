@@ -0,0 +1,45 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error code S3 returns for a missing object
+const CODE_NO_SUCH_KEY = "NoSuchKey"
+
+// ClientError is a failed S3 request
+type ClientError struct {
+  Status int `xml:"-"`
+  Code string `xml:"Code"`
+  Message string `xml:"Message"`
+  Resource string `xml:"Resource"`
+  RequestId string `xml:"RequestId"`
+}
+
+func (e *ClientError) Error() string {
+  message := e.Message
+  if message == "" {
+    message = http.StatusText(e.Status)
+  }
+
+  if e.Code == "" {
+    return fmt.Sprintf("s3: %s (status %d)", message, e.Status)
+  }
+
+  return fmt.Sprintf("s3: %s (status %d, code %s)", message, e.Status, e.Code)
+}
+
+func asClientError(err error) (*ClientError, bool) {
+  var clientErr *ClientError
+  ok := errors.As(err, &clientErr)
+  return clientErr, ok
+}
+
+// IsNotFound reports whether the object a request was about does not
+// exist
+func IsNotFound(err error) bool {
+  clientErr, ok := asClientError(err)
+  return ok && (clientErr.Status == http.StatusNotFound || clientErr.Code == CODE_NO_SUCH_KEY)
+}
@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const SIGNING_ALGORITHM = "AWS4-HMAC-SHA256"
+const AMZ_DATE_FORMAT = "20060102T150405Z"
+
+// EMPTY_PAYLOAD_HASH is the SHA-256 of an empty body
+const EMPTY_PAYLOAD_HASH = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func hmacSHA256(key []byte, data string) []byte {
+  h := hmac.New(sha256.New, key)
+  h.Write([]byte(data))
+  return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+// uriEncode escapes everything except the unreserved characters, the
+// way signature version 4 expects. Slashes are kept when encoding a
+// path.
+func uriEncode(s string, path bool) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    switch {
+    case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+      b.WriteByte(c)
+    case c == '-' || c == '_' || c == '.' || c == '~':
+      b.WriteByte(c)
+    case c == '/' && path:
+      b.WriteByte(c)
+    default:
+      fmt.Fprintf(&b, "%%%02X", c)
+    }
+  }
+
+  return b.String()
+}
+
+func canonicalQuery(req *http.Request) string {
+  query := req.URL.Query()
+
+  var params []string
+  for key, values := range query {
+    for _, value := range values {
+      params = append(params, uriEncode(key, false) + "=" + uriEncode(value, false))
+    }
+  }
+  sort.Strings(params)
+
+  return strings.Join(params, "&")
+}
+
+// sign adds signature version 4 headers to req, whose body hashes to
+// payloadHash. Every header already set is signed.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+  amzDate := now.UTC().Format(AMZ_DATE_FORMAT)
+  date := amzDate[:8]
+
+  req.Header.Set("x-amz-date", amzDate)
+  req.Header.Set("x-amz-content-sha256", payloadHash)
+  if c.opts.SessionToken != "" {
+    req.Header.Set("x-amz-security-token", c.opts.SessionToken)
+  }
+
+  headers := map[string]string{
+    "host": req.URL.Host,
+  }
+  for name := range req.Header {
+    lower := strings.ToLower(name)
+    if lower != "authorization" {
+      headers[lower] = strings.TrimSpace(req.Header.Get(name))
+    }
+  }
+
+  var names []string
+  for name := range headers {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  var canonicalHeaders strings.Builder
+  for _, name := range names {
+    canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+  }
+  signedHeaders := strings.Join(names, ";")
+
+  canonicalRequest := strings.Join([]string{
+    req.Method,
+    req.URL.EscapedPath(),
+    canonicalQuery(req),
+    canonicalHeaders.String(),
+    signedHeaders,
+    payloadHash,
+  }, "\n")
+
+  scope := date + "/" + c.opts.Region + "/s3/aws4_request"
+  stringToSign := strings.Join([]string{
+    SIGNING_ALGORITHM,
+    amzDate,
+    scope,
+    hashHex([]byte(canonicalRequest)),
+  }, "\n")
+
+  key := hmacSHA256([]byte("AWS4" + c.opts.SecretAccessKey), date)
+  key = hmacSHA256(key, c.opts.Region)
+  key = hmacSHA256(key, "s3")
+  key = hmacSHA256(key, "aws4_request")
+  signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+  req.Header.Set("Authorization", fmt.Sprintf(
+    "%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+    SIGNING_ALGORITHM,
+    c.opts.AccessKeyId,
+    scope,
+    signedHeaders,
+    signature,
+  ))
+}
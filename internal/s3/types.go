@@ -0,0 +1,44 @@
+package s3
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// Object is an object stored in a bucket
+type Object struct {
+  Key string `xml:"Key"`
+  Size int64 `xml:"Size"`
+  ETag string `xml:"ETag"`
+  LastModified time.Time `xml:"LastModified"`
+}
+
+type ListObjectsResponse struct {
+  XMLName xml.Name `xml:"ListBucketResult"`
+  Contents []Object `xml:"Contents"`
+  IsTruncated bool `xml:"IsTruncated"`
+  NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type CreateMultipartUploadResponse struct {
+  XMLName xml.Name `xml:"InitiateMultipartUploadResult"`
+  Bucket string `xml:"Bucket"`
+  Key string `xml:"Key"`
+  UploadId string `xml:"UploadId"`
+}
+
+type CompletedPart struct {
+  PartNumber int `xml:"PartNumber"`
+  ETag string `xml:"ETag"`
+}
+
+type CompleteMultipartUploadRequest struct {
+  XMLName xml.Name `xml:"CompleteMultipartUpload"`
+  Parts []CompletedPart `xml:"Part"`
+}
+
+type CompleteMultipartUploadResponse struct {
+  XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+  Key string `xml:"Key"`
+  ETag string `xml:"ETag"`
+}
@@ -0,0 +1,264 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule works out when a job should next run
+type Schedule interface {
+  // Next returns the first run time strictly after t
+  Next(t time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval from the previous run
+type everySchedule struct {
+  interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+  return t.Add(s.interval)
+}
+
+// cronSchedule holds the allowed values of each cron field as bitsets
+type cronSchedule struct {
+  minute uint64
+  hour uint64
+  dom uint64
+  month uint64
+  dow uint64
+  // Following cron, when both day fields are restricted a day matches
+  // if either of them does
+  domStar bool
+  dowStar bool
+}
+
+type fieldBounds struct {
+  min int
+  max int
+  names map[string]int
+}
+
+var minuteBounds = fieldBounds{min: 0, max: 59}
+var hourBounds = fieldBounds{min: 0, max: 23}
+var domBounds = fieldBounds{min: 1, max: 31}
+var monthBounds = fieldBounds{
+  min: 1,
+  max: 12,
+  names: map[string]int{
+    "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+    "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+  },
+}
+var dowBounds = fieldBounds{
+  min: 0,
+  max: 7,
+  names: map[string]int{
+    "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+  },
+}
+
+var descriptors = map[string]string{
+  "@yearly": "0 0 1 1 *",
+  "@annually": "0 0 1 1 *",
+  "@monthly": "0 0 1 * *",
+  "@weekly": "0 0 * * 0",
+  "@daily": "0 0 * * *",
+  "@midnight": "0 0 * * *",
+  "@hourly": "0 * * * *",
+}
+
+// Parse accepts five field cron expressions, the usual @daily style
+// descriptors and "@every <duration>"
+func Parse(expr string) (Schedule, error) {
+  expr = strings.TrimSpace(expr)
+
+  if strings.HasPrefix(expr, "@every ") {
+    interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+    if err != nil {
+      return nil, err
+    }
+    if interval <= 0 {
+      return nil, errors.New("@every interval must be positive")
+    }
+
+    return everySchedule{interval: interval}, nil
+  }
+
+  if descriptor, ok := descriptors[expr]; ok {
+    expr = descriptor
+  }
+
+  fields := strings.Fields(expr)
+  if len(fields) != 5 {
+    return nil, errors.New("Expected 5 fields in cron expression " + expr)
+  }
+
+  var s cronSchedule
+  var err error
+  if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+    return nil, err
+  }
+  if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+    return nil, err
+  }
+  if s.dom, err = parseField(fields[2], domBounds); err != nil {
+    return nil, err
+  }
+  if s.month, err = parseField(fields[3], monthBounds); err != nil {
+    return nil, err
+  }
+  if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+    return nil, err
+  }
+
+  // Sunday can be written as 0 or 7
+  if s.dow&(1<<7) != 0 {
+    s.dow |= 1
+  }
+
+  s.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+  s.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+
+  return s, nil
+}
+
+func parseValue(value string, bounds fieldBounds) (int, error) {
+  if n, ok := bounds.names[strings.ToLower(value)]; ok {
+    return n, nil
+  }
+
+  n, err := strconv.Atoi(value)
+  if err != nil {
+    return 0, errors.New("Invalid cron value " + value)
+  }
+
+  if n < bounds.min || n > bounds.max {
+    return 0, errors.New("Cron value " + value + " out of range")
+  }
+
+  return n, nil
+}
+
+func parseField(field string, bounds fieldBounds) (uint64, error) {
+  var bits uint64
+
+  for _, part := range strings.Split(field, ",") {
+    step := 1
+    if i := strings.Index(part, "/"); i >= 0 {
+      var err error
+      step, err = strconv.Atoi(part[i+1:])
+      if err != nil || step <= 0 {
+        return 0, errors.New("Invalid cron step in " + part)
+      }
+      part = part[:i]
+    }
+
+    start, end := bounds.min, bounds.max
+    if part != "*" {
+      var err error
+      if i := strings.Index(part, "-"); i >= 0 {
+        if start, err = parseValue(part[:i], bounds); err != nil {
+          return 0, err
+        }
+        if end, err = parseValue(part[i+1:], bounds); err != nil {
+          return 0, err
+        }
+      } else {
+        if start, err = parseValue(part, bounds); err != nil {
+          return 0, err
+        }
+        // "5/15" means every 15 starting at 5
+        if step == 1 {
+          end = start
+        }
+      }
+    }
+
+    if start > end {
+      return 0, errors.New("Invalid cron range " + part)
+    }
+
+    for n := start; n <= end; n += step {
+      bits |= 1 << uint(n)
+    }
+  }
+
+  return bits, nil
+}
+
+func has(bits uint64, n int) bool {
+  return bits&(1<<uint(n)) != 0
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+  domMatch := has(s.dom, t.Day())
+  dowMatch := has(s.dow, int(t.Weekday()))
+
+  if s.domStar || s.dowStar {
+    return domMatch && dowMatch
+  }
+
+  return domMatch || dowMatch
+}
+
+// wallClock drops the zone of t, leaving the time a clock on the wall
+// shows
+func wallClock(t time.Time) time.Time {
+  return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// nextHour is the start of the hour after t. Adding to t keeps moving
+// forward when the clocks go forward, time.Date maps a wall time that
+// does not exist back to the hour before.
+func nextHour(t time.Time) time.Time {
+  return t.Add(time.Duration(60 - t.Minute()) * time.Minute)
+}
+
+// moveTo returns start, or the next hour when a clock change maps start
+// back to t or earlier
+func moveTo(t time.Time, start time.Time) time.Time {
+  if start.After(t) {
+    return start
+  }
+
+  return nextHour(t)
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+  after := wallClock(t)
+  t = t.Truncate(time.Minute).Add(time.Minute)
+
+  // Any valid expression matches within a few years, anything past
+  // that is an impossible date such as the 30th of February
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    if !has(s.month, int(t.Month())) {
+      t = moveTo(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+      continue
+    }
+
+    if !s.dayMatches(t) {
+      t = moveTo(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+      continue
+    }
+
+    if !has(s.hour, t.Hour()) {
+      t = nextHour(t)
+      continue
+    }
+
+    // When the clocks go back an hour comes round twice, a job only
+    // runs the first time
+    if !has(s.minute, t.Minute()) || !wallClock(t).After(after) {
+      t = t.Add(time.Minute)
+      continue
+    }
+
+    return t
+  }
+
+  return time.Time{}
+}
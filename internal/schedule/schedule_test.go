@@ -0,0 +1,117 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func parseTime(t *testing.T, loc *time.Location, value string) time.Time {
+  t.Helper()
+
+  parsed, err := time.Parse("2006-01-02 15:04 -0700", value)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return parsed.In(loc)
+}
+
+func TestParseErrors(t *testing.T) {
+  tests := []string{
+    "",
+    "* * * *",
+    "* * * * * *",
+    "60 * * * *",
+    "* 24 * * *",
+    "* * 0 * *",
+    "* * * 13 *",
+    "* * * * 8",
+    "5-1 * * * *",
+    "*/0 * * * *",
+    "a * * * *",
+    "* * * foo *",
+    "@bogus",
+    "@every 0s",
+    "@every -5m",
+    "@every soon",
+  }
+
+  for _, expr := range tests {
+    t.Run(expr, func(t *testing.T) {
+      _, err := Parse(expr)
+      if err == nil {
+        t.Errorf("Parse(%q) succeeded, want an error", expr)
+      }
+    })
+  }
+}
+
+func TestNext(t *testing.T) {
+  newYork, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    t.Skip("no time zone data:", err)
+  }
+  // Santiago moves its clocks forward at midnight
+  santiago, err := time.LoadLocation("America/Santiago")
+  if err != nil {
+    t.Skip("no time zone data:", err)
+  }
+
+  tests := []struct {
+    name string
+    expr string
+    loc *time.Location
+    from string
+    want string
+  }{
+    {"every", "@every 90m", time.UTC, "2026-01-01 10:07 +0000", "2026-01-01 11:37 +0000"},
+    {"every hour", "@every 1h", time.UTC, "2026-01-01 10:07 +0000", "2026-01-01 11:07 +0000"},
+    {"step", "*/15 * * * *", time.UTC, "2026-01-01 10:07 +0000", "2026-01-01 10:15 +0000"},
+    {"step from start", "5/15 * * * *", time.UTC, "2026-01-01 10:06 +0000", "2026-01-01 10:20 +0000"},
+    {"strictly after", "0 * * * *", time.UTC, "2026-01-01 10:00 +0000", "2026-01-01 11:00 +0000"},
+    {"list", "0 6,18 * * *", time.UTC, "2026-01-01 07:00 +0000", "2026-01-01 18:00 +0000"},
+    {"next day", "30 2 * * *", time.UTC, "2026-01-01 03:00 +0000", "2026-01-02 02:30 +0000"},
+    {"daily", "@daily", time.UTC, "2026-12-31 23:59 +0000", "2027-01-01 00:00 +0000"},
+    {"monthly at month end", "@monthly", time.UTC, "2026-01-31 12:00 +0000", "2026-02-01 00:00 +0000"},
+    {"31st skips short months", "0 0 31 * *", time.UTC, "2026-04-15 00:00 +0000", "2026-05-31 00:00 +0000"},
+    {"leap day", "0 0 29 2 *", time.UTC, "2026-03-01 00:00 +0000", "2028-02-29 00:00 +0000"},
+    {"impossible date", "0 0 30 2 *", time.UTC, "2026-01-01 00:00 +0000", ""},
+    {"month names", "0 0 1 jan,jul *", time.UTC, "2026-02-01 00:00 +0000", "2026-07-01 00:00 +0000"},
+    {"weekdays", "0 12 * * mon-fri", time.UTC, "2026-10-16 13:00 +0000", "2026-10-19 12:00 +0000"},
+    {"sunday as 7", "0 0 * * 7", time.UTC, "2026-01-01 00:00 +0000", "2026-01-04 00:00 +0000"},
+    {"weekly", "@weekly", time.UTC, "2026-01-01 00:00 +0000", "2026-01-04 00:00 +0000"},
+    {"day of month or week", "0 0 13 * fri", time.UTC, "2026-01-10 00:00 +0000", "2026-01-13 00:00 +0000"},
+    {"day of week or month", "0 0 13 * fri", time.UTC, "2026-01-01 00:00 +0000", "2026-01-02 00:00 +0000"},
+    {"day of month with day of week step", "0 0 13 * */1", time.UTC, "2026-01-01 00:00 +0000", "2026-01-13 00:00 +0000"},
+    {"same time across spring forward", "0 12 * * *", newYork, "2026-03-07 12:00 -0500", "2026-03-08 12:00 -0400"},
+    {"skipped hour", "30 2 * * *", newYork, "2026-03-08 00:00 -0500", "2026-03-09 02:30 -0400"},
+    {"step across skipped hour", "*/30 * * * *", newYork, "2026-03-08 01:45 -0500", "2026-03-08 03:00 -0400"},
+    {"first of a repeated hour", "30 1 * * *", newYork, "2026-11-01 00:00 -0400", "2026-11-01 01:30 -0400"},
+    {"repeated hour runs once", "30 1 * * *", newYork, "2026-11-01 01:30 -0400", "2026-11-02 01:30 -0500"},
+    {"step after repeated hour", "*/15 * * * *", newYork, "2026-11-01 01:45 -0400", "2026-11-01 02:00 -0500"},
+    {"skipped midnight", "@daily", santiago, "2026-09-05 00:00 -0400", "2026-09-07 00:00 -0300"},
+    {"hour after skipped midnight", "0 1 * * *", santiago, "2026-09-05 12:00 -0400", "2026-09-06 01:00 -0300"},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      sched, err := Parse(test.expr)
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      got := sched.Next(parseTime(t, test.loc, test.from))
+      if test.want == "" {
+        if !got.IsZero() {
+          t.Errorf("Next = %s, want no run", got)
+        }
+        return
+      }
+
+      want := parseTime(t, test.loc, test.want)
+      if !got.Equal(want) {
+        t.Errorf("Next = %s, want %s", got, want)
+      }
+    })
+  }
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/jdollar/backup/internal/box"
+)
+
+// BOX_PAGE_SIZE is the largest page the box folder listing allows
+const BOX_PAGE_SIZE = 1000
+
+// Box stores objects as files in a single box folder
+type Box struct {
+  client *box.Client
+  folder box.Folder
+  files map[string]box.File
+}
+
+func NewBox(client *box.Client, folder box.Folder) *Box {
+  return &Box{
+    client: client,
+    folder: folder,
+  }
+}
+
+func (b *Box) Save(ctx context.Context, name string, r io.Reader, size int64) (Object, error) {
+  file, err := b.client.Upload(ctx, b.folder, name, r, size)
+  if box.IsConflict(err) {
+    return Object{}, ErrExists
+  }
+  if err != nil {
+    return Object{}, err
+  }
+
+  if b.files != nil {
+    b.files[file.Name] = file
+  }
+
+  return Object{
+    Id: file.Id,
+    Name: file.Name,
+    Size: file.Size,
+    Sha1: file.Sha1,
+  }, nil
+}
+
+func (b *Box) lookup(ctx context.Context, name string) (box.File, error) {
+  if b.files == nil {
+    _, err := b.List(ctx)
+    if err != nil {
+      return box.File{}, err
+    }
+  }
+
+  file, ok := b.files[name]
+  if !ok {
+    return box.File{}, ErrNotFound
+  }
+
+  return file, nil
+}
+
+func (b *Box) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+  file, err := b.lookup(ctx, name)
+  if err != nil {
+    return nil, err
+  }
+
+  r, err := b.client.DownloadFile(ctx, file)
+  if box.IsNotFound(err) {
+    return nil, ErrNotFound
+  }
+
+  return r, err
+}
+
+func (b *Box) List(ctx context.Context) ([]Object, error) {
+  files := map[string]box.File{}
+  var objects []Object
+
+  for offset := int64(0); ; offset += BOX_PAGE_SIZE {
+    listResp, err := b.client.ListItemsInFolder(ctx, b.folder, BOX_PAGE_SIZE, offset)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, file := range listResp.Entries {
+      if file.Type != "file" {
+        continue
+      }
+
+      files[file.Name] = file
+      objects = append(objects, Object{
+        Id: file.Id,
+        Name: file.Name,
+        Size: file.Size,
+        Sha1: file.Sha1,
+      })
+    }
+
+    if len(listResp.Entries) < BOX_PAGE_SIZE || offset+BOX_PAGE_SIZE >= listResp.TotalCount {
+      break
+    }
+  }
+
+  b.files = files
+
+  return objects, nil
+}
+
+func (b *Box) Remove(ctx context.Context, name string) error {
+  file, err := b.lookup(ctx, name)
+  if err != nil {
+    return err
+  }
+
+  err = b.client.DeleteFile(ctx, file)
+  if box.IsNotFound(err) {
+    // Deleted elsewhere since it was listed
+    delete(b.files, name)
+    return ErrNotFound
+  }
+  if err != nil {
+    return err
+  }
+
+  delete(b.files, name)
+
+  return nil
+}
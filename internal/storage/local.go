@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jdollar/backup/internal/files"
+)
+
+// Local stores objects as files in a directory, which can also be a
+// mounted network share
+type Local struct {
+  Path string
+}
+
+func NewLocal(path string) (*Local, error) {
+  err := os.MkdirAll(path, os.ModePerm)
+  if err != nil {
+    return nil, err
+  }
+
+  return &Local{
+    Path: path,
+  }, nil
+}
+
+func (l *Local) Save(ctx context.Context, name string, r io.Reader, size int64) (Object, error) {
+  // Write to a temporary file in the same directory first so readers
+  // never see a partially written object
+  tmp, err := ioutil.TempFile(l.Path, "."+name+".*")
+  if err != nil {
+    return Object{}, err
+  }
+
+  h := sha1.New()
+  written, err := io.Copy(tmp, io.TeeReader(files.NewContextReader(ctx, r), h))
+  if err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return Object{}, err
+  }
+
+  err = tmp.Close()
+  if err != nil {
+    os.Remove(tmp.Name())
+    return Object{}, err
+  }
+
+  path := filepath.Join(l.Path, name)
+  err = os.Rename(tmp.Name(), path)
+  if err != nil {
+    os.Remove(tmp.Name())
+    return Object{}, err
+  }
+
+  return Object{
+    Id: path,
+    Name: name,
+    Size: written,
+    Sha1: hex.EncodeToString(h.Sum(nil)),
+  }, nil
+}
+
+// SaveStream saves an object of unknown size, Local never needs it
+func (l *Local) SaveStream(ctx context.Context, name string, r io.Reader) (Object, error) {
+  return l.Save(ctx, name, r, -1)
+}
+
+// localReader stops reading a file once its context is cancelled
+type localReader struct {
+  io.Reader
+  file *os.File
+}
+
+func (r localReader) Close() error {
+  return r.file.Close()
+}
+
+func (l *Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+  file, err := os.Open(filepath.Join(l.Path, name))
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, ErrNotFound
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return localReader{
+    Reader: files.NewContextReader(ctx, file),
+    file: file,
+  }, nil
+}
+
+func (l *Local) List(ctx context.Context) ([]Object, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+
+  entries, err := ioutil.ReadDir(l.Path)
+  if err != nil {
+    return nil, err
+  }
+
+  var objects []Object
+  for _, entry := range entries {
+    if entry.IsDir() || entry.Name()[0] == '.' {
+      continue
+    }
+
+    objects = append(objects, Object{
+      Id: filepath.Join(l.Path, entry.Name()),
+      Name: entry.Name(),
+      Size: entry.Size(),
+    })
+  }
+
+  return objects, nil
+}
+
+func (l *Local) Remove(ctx context.Context, name string) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+
+  err := os.Remove(filepath.Join(l.Path, name))
+  if errors.Is(err, os.ErrNotExist) {
+    return ErrNotFound
+  }
+
+  return err
+}
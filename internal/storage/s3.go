@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/jdollar/backup/internal/s3"
+)
+
+// S3 stores objects under a prefix of a bucket in S3 or a service with
+// the same API. Objects are overwritten like files in Local.
+type S3 struct {
+  client *s3.Client
+  prefix string
+}
+
+// NewS3 stores objects under prefix, which is treated as a directory
+func NewS3(client *s3.Client, prefix string) *S3 {
+  prefix = strings.Trim(prefix, "/")
+  if prefix != "" {
+    prefix += "/"
+  }
+
+  return &S3{
+    client: client,
+    prefix: prefix,
+  }
+}
+
+func (s *S3) Save(ctx context.Context, name string, r io.Reader, size int64) (Object, error) {
+  h := sha1.New()
+  object, err := s.client.Upload(ctx, s.prefix + name, io.TeeReader(r, h), size)
+  if err != nil {
+    return Object{}, err
+  }
+
+  return Object{
+    Id: object.Key,
+    Name: name,
+    Size: object.Size,
+    Sha1: hex.EncodeToString(h.Sum(nil)),
+  }, nil
+}
+
+// SaveStream saves an object of unknown size through a multipart upload
+func (s *S3) SaveStream(ctx context.Context, name string, r io.Reader) (Object, error) {
+  return s.Save(ctx, name, r, -1)
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+  r, err := s.client.GetObject(ctx, s.prefix + name)
+  if s3.IsNotFound(err) {
+    return nil, ErrNotFound
+  }
+
+  return r, err
+}
+
+func (s *S3) List(ctx context.Context) ([]Object, error) {
+  var objects []Object
+  token := ""
+  for {
+    listResp, err := s.client.ListObjects(ctx, s.prefix, token)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, object := range listResp.Contents {
+      objects = append(objects, Object{
+        Id: object.Key,
+        Name: strings.TrimPrefix(object.Key, s.prefix),
+        Size: object.Size,
+      })
+    }
+
+    if !listResp.IsTruncated || listResp.NextContinuationToken == "" {
+      break
+    }
+    token = listResp.NextContinuationToken
+  }
+
+  return objects, nil
+}
+
+func (s *S3) Remove(ctx context.Context, name string) error {
+  return s.client.DeleteObject(ctx, s.prefix + name)
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// ErrExists is returned by backends that refuse to overwrite an object
+var ErrExists = errors.New("object already exists")
+
+// Object describes a stored file
+type Object struct {
+  Id string
+  Name string
+  Size int64
+  Sha1 string
+}
+
+// Backend is a flat namespace of named objects that backups and
+// repository files can be written to. Cancelling ctx aborts a call,
+// for Open it also aborts reading the returned object.
+type Backend interface {
+  Save(ctx context.Context, name string, r io.Reader, size int64) (Object, error)
+  Open(ctx context.Context, name string) (io.ReadCloser, error)
+  List(ctx context.Context) ([]Object, error)
+  Remove(ctx context.Context, name string) error
+}
+
+// StreamingBackend is a backend that can save an object without
+// knowing its size up front, so it can receive an archive while the
+// archive is still being written
+type StreamingBackend interface {
+  Backend
+  SaveStream(ctx context.Context, name string, r io.Reader) (Object, error)
+}